@@ -49,6 +49,10 @@ func NewFileAuthProvider(config json.RawMessage) AuthProvider {
 	return &FileAuthProvider{config: c}
 }
 
+func (a *FileAuthProvider) StoragePath() string {
+	return a.config.FilePath
+}
+
 func (a *FileAuthProvider) AuthenticateUser(username, password string) bool {
 	err := a.LoadUsers()
 	if err != nil {
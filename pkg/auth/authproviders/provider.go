@@ -24,6 +24,7 @@ package authproviders
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
 )
 
 type AuthProvider interface {
@@ -41,42 +42,53 @@ type AuthProvider interface {
 
 type AuthProviderFactory func(config json.RawMessage) AuthProvider
 
-var authProvider AuthProvider
+var (
+	authProvider      AuthProvider
+	authProviderMutex sync.RWMutex
+)
 
+// SetAuthProviderFactory builds the provider and swaps it in, the requests
+// being served keep using the previous one.
 func SetAuthProviderFactory(factory AuthProviderFactory, config json.RawMessage) {
-	authProvider = factory(config)
+	provider := factory(config)
+
+	authProviderMutex.Lock()
+	defer authProviderMutex.Unlock()
+	authProvider = provider
 }
 
 func GetAuthProvider() AuthProvider {
+	authProviderMutex.RLock()
+	defer authProviderMutex.RUnlock()
 	return authProvider
 }
 
 func AuthenticateUser(username, password string) bool {
-	return authProvider.AuthenticateUser(username, password)
+	return GetAuthProvider().AuthenticateUser(username, password)
 }
 
 func AddUser(username, password string) error {
-	return authProvider.AddUser(username, password)
+	return GetAuthProvider().AddUser(username, password)
 }
 
 func RemoveUser(username string) error {
-	return authProvider.RemoveUser(username)
+	return GetAuthProvider().RemoveUser(username)
 }
 
 func GetUsers() ([]string, error) {
-	return authProvider.GetUsers()
+	return GetAuthProvider().GetUsers()
 }
 
 func ChangePassword(username, password string) error {
-	return authProvider.ChangePassword(username, password)
+	return GetAuthProvider().ChangePassword(username, password)
 }
 
 func DropUsers() error {
-	return authProvider.DropUsers()
+	return GetAuthProvider().DropUsers()
 }
 
 func GetRole(username string) (string, error) {
-	return authProvider.GetRole(username)
+	return GetAuthProvider().GetRole(username)
 }
 
 func InitializeAuthProvider(provider string, config json.RawMessage) error {
@@ -94,13 +106,20 @@ func InitializeAuthProvider(provider string, config json.RawMessage) error {
 }
 
 func LoadUsers() error {
-	return authProvider.LoadUsers()
+	return GetAuthProvider().LoadUsers()
 }
 
 func GetUser(username string) (UserView, error) {
-	return authProvider.GetUser(username)
+	return GetAuthProvider().GetUser(username)
 }
 
 func SetRole(username, role string) error {
-	return authProvider.SetRole(username, role)
+	return GetAuthProvider().SetRole(username, role)
+}
+
+func GetStoragePath() string {
+	if p, ok := GetAuthProvider().(interface{ StoragePath() string }); ok {
+		return p.StoragePath()
+	}
+	return ""
 }
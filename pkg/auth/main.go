@@ -24,6 +24,7 @@ package auth
 import (
 	"encoding/json"
 	"errors"
+	"sync"
 
 	"github.com/a13labs/m3uproxy/pkg/auth/authproviders"
 )
@@ -35,28 +36,53 @@ type AuthConfig struct {
 	Settings       json.RawMessage `json:"settings"`
 }
 
-var authConfig AuthConfig
+var (
+	authConfig      AuthConfig
+	authConfigMutex sync.RWMutex
+)
+
+// currentAuthConfig returns the configuration in use, replaced when the
+// authentication is re-initialized.
+func currentAuthConfig() AuthConfig {
+	authConfigMutex.RLock()
+	defer authConfigMutex.RUnlock()
+	return authConfig
+}
 
 func InitializeAuth(data json.RawMessage) error {
 
-	err := json.Unmarshal(data, &authConfig)
+	config := AuthConfig{}
+	err := json.Unmarshal(data, &config)
 	if err != nil {
 		return err
 	}
 
-	if authConfig.Provider == "" {
+	if config.Provider == "" {
 		return errors.New("auth provider is required")
 	}
 
-	if len(authConfig.SecretKey) == 0 {
+	if len(config.SecretKey) == 0 {
 		return errors.New("secret key is required")
 	}
 
-	if authConfig.ExpirationTime == 0 {
-		authConfig.ExpirationTime = 24
+	if config.ExpirationTime == 0 {
+		config.ExpirationTime = 24
+	}
+
+	if err := authproviders.InitializeAuthProvider(config.Provider, config.Settings); err != nil {
+		return err
 	}
 
-	return authproviders.InitializeAuthProvider(authConfig.Provider, authConfig.Settings)
+	authConfigMutex.Lock()
+	authConfig = config
+	authConfigMutex.Unlock()
+	return nil
+}
+
+// GetStoragePath returns the file backing the current auth provider, or an
+// empty string if the provider does not keep its users on disk.
+func GetStoragePath() string {
+	return authproviders.GetStoragePath()
 }
 
 func GetRole(username string) (string, error) {
@@ -23,14 +23,21 @@ package auth
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+var (
+	// revokedTokens holds the revoked tokens until they expire.
+	revokedTokens      = make(map[string]time.Time)
+	revokedTokensMutex sync.Mutex
+)
+
 func createJWT(userID, role string) (string, error) {
 	// Define token expiration time
-	expirationTime := time.Now().Add(time.Hour * time.Duration(authConfig.ExpirationTime)) // 1 hour expiry
+	expirationTime := time.Now().Add(time.Hour * time.Duration(currentAuthConfig().ExpirationTime)) // 1 hour expiry
 
 	// Define the claims
 	claims := jwt.MapClaims{
@@ -44,7 +51,7 @@ func createJWT(userID, role string) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
 	// Sign the token with your secret key
-	tokenString, err := token.SignedString([]byte(authConfig.SecretKey))
+	tokenString, err := token.SignedString([]byte(currentAuthConfig().SecretKey))
 	if err != nil {
 		return "", err
 	}
@@ -59,7 +66,7 @@ func verifyJWT(tokenString string) (jwt.MapClaims, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method")
 		}
-		return []byte(authConfig.SecretKey), nil
+		return []byte(currentAuthConfig().SecretKey), nil
 	})
 
 	// Handle errors
@@ -67,6 +74,10 @@ func verifyJWT(tokenString string) (jwt.MapClaims, error) {
 		return nil, err
 	}
 
+	if isRevoked(tokenString) {
+		return nil, fmt.Errorf("token revoked")
+	}
+
 	// Extract claims if the token is valid
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
 		return claims, nil
@@ -126,3 +137,34 @@ func GetUserFromToken(token string) (string, error) {
 	}
 	return "", fmt.Errorf("user id not found")
 }
+
+// RevokeToken invalidates a token before it expires.
+func RevokeToken(token string) error {
+	claims, err := verifyJWT(token)
+	if err != nil {
+		return err
+	}
+	expiration, err := claims.GetExpirationTime()
+	if err != nil || expiration == nil {
+		return fmt.Errorf("token without expiration time")
+	}
+
+	revokedTokensMutex.Lock()
+	defer revokedTokensMutex.Unlock()
+
+	now := time.Now()
+	for revoked, expires := range revokedTokens {
+		if now.After(expires) {
+			delete(revokedTokens, revoked)
+		}
+	}
+	revokedTokens[token] = expiration.Time
+	return nil
+}
+
+func isRevoked(token string) bool {
+	revokedTokensMutex.Lock()
+	defer revokedTokensMutex.Unlock()
+	_, ok := revokedTokens[token]
+	return ok
+}
@@ -0,0 +1,274 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package fetch
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTimeout    = 30
+	DefaultRetryDelay = 1
+	DefaultUserAgent  = "m3uproxy"
+)
+
+var ErrTooLarge = errors.New("content exceeds maximum size")
+
+// Config describes how a remote source must be fetched. It is meant to be
+// embedded in provider and EPG configurations.
+type Config struct {
+	Headers     map[string]string `json:"headers,omitempty"`
+	UserAgent   string            `json:"user_agent,omitempty"`
+	Username    string            `json:"username,omitempty"`
+	Password    string            `json:"password,omitempty"`
+	BearerToken string            `json:"bearer_token,omitempty"`
+	Proxy       string            `json:"proxy,omitempty"`
+	Timeout     int               `json:"timeout,omitempty"`
+	MaxSize     int64             `json:"max_size,omitempty"`
+	Retries     int               `json:"retries,omitempty"`
+	RetryDelay  int               `json:"retry_delay,omitempty"`
+}
+
+var (
+	transports      = make(map[string]*http.Transport)
+	transportsMutex sync.Mutex
+)
+
+func IsRemote(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// Validate checks the configuration without performing any request.
+func (c *Config) Validate() error {
+	if _, err := ParseProxies(c.Proxy); err != nil {
+		return err
+	}
+	if c.Timeout < 0 || c.MaxSize < 0 || c.Retries < 0 || c.RetryDelay < 0 {
+		return errors.New("timeout, max_size, retries and retry_delay must not be negative")
+	}
+	if c.BearerToken != "" && c.Username != "" {
+		return errors.New("bearer_token and username are mutually exclusive")
+	}
+	return nil
+}
+
+func parseProxy(proxy string) (*url.URL, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme '%s'", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy '%s'", proxy)
+	}
+	return proxyURL, nil
+}
+
+// getTransport returns a transport shared by every fetch using the same proxy,
+// or chain of proxies, so repeated refreshes reuse connections.
+func getTransport(proxy string) (*http.Transport, error) {
+	transportsMutex.Lock()
+	defer transportsMutex.Unlock()
+
+	if t, ok := transports[proxy]; ok {
+		return t, nil
+	}
+
+	proxies, err := ParseProxies(proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	SetProxies(t, proxies, &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second})
+	transports[proxy] = t
+	return t, nil
+}
+
+func (c *Config) newRequest(ctx context.Context, source string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	userAgent := c.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	for key, value := range c.Headers {
+		req.Header.Set(key, value)
+	}
+
+	if c.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	} else if c.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password))
+		req.Header.Set("Authorization", "Basic "+credentials)
+	}
+
+	return req, nil
+}
+
+func retryable(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+func (c *Config) get(ctx context.Context, source string) (*http.Response, error) {
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	transport, err := getTransport(c.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	client := &http.Client{
+		Timeout:   time.Duration(timeout) * time.Second,
+		Transport: transport,
+	}
+
+	delay := time.Duration(c.RetryDelay) * time.Second
+	if delay == 0 {
+		delay = DefaultRetryDelay * time.Second
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := c.newRequest(ctx, source)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(req)
+		if err == nil && resp.StatusCode/100 == 2 {
+			return resp, nil
+		}
+
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("invalid server status: %s", resp.Status)
+			if !retryable(resp.StatusCode) {
+				return nil, err
+			}
+		}
+
+		if attempt >= c.Retries {
+			return nil, err
+		}
+
+		log.Printf("Fetching %s failed (%s), retrying in %s\n", source, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+type limitedReader struct {
+	io.ReadCloser
+	remaining int64
+}
+
+// Read allows one byte past the limit so content of exactly the maximum size
+// is not mistaken for oversized content.
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, ErrTooLarge
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n, ErrTooLarge
+	}
+	return n, err
+}
+
+// Open returns a reader for a local file or a remote http(s) source. The
+// caller is responsible for closing it.
+func Open(source string, config Config) (io.ReadCloser, error) {
+	return OpenContext(context.Background(), source, config)
+}
+
+// OpenContext is like Open, a remote source is given up, retries and reading
+// the body included, once ctx is done.
+func OpenContext(ctx context.Context, source string, config Config) (io.ReadCloser, error) {
+
+	if !IsRemote(source) {
+		return os.Open(source)
+	}
+
+	resp, err := config.get(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.MaxSize > 0 {
+		if resp.ContentLength > config.MaxSize {
+			resp.Body.Close()
+			return nil, ErrTooLarge
+		}
+		return &limitedReader{ReadCloser: resp.Body, remaining: config.MaxSize}, nil
+	}
+
+	return resp.Body, nil
+}
+
+// ReadAll fetches the whole content of a local file or a remote source.
+func ReadAll(source string, config Config) ([]byte, error) {
+
+	reader, err := Open(source, config)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
@@ -0,0 +1,311 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package fetch
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseProxies parses a proxy, or a comma separated chain of proxies the
+// connections go through in order. Supported schemes are http, https,
+// socks5 and socks5h, with optional credentials.
+func ParseProxies(spec string) ([]*url.URL, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	proxies := make([]*url.URL, 0)
+	for _, proxy := range strings.Split(spec, ",") {
+		proxyURL, err := parseProxy(strings.TrimSpace(proxy))
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, proxyURL)
+	}
+	return proxies, nil
+}
+
+// SetProxies routes the connections of a transport through proxies. A
+// single proxy is handled by the transport, chains are dialed hop by hop.
+func SetProxies(transport *http.Transport, proxies []*url.URL, dialer *net.Dialer) {
+	switch len(proxies) {
+	case 0:
+	case 1:
+		transport.Proxy = http.ProxyURL(proxies[0])
+	default:
+		transport.Proxy = nil
+		transport.DialContext = ProxyDialer(proxies, dialer)
+	}
+}
+
+// ProxyDialer returns a dial function reaching its address through a chain
+// of proxies, each one being asked to connect to the next.
+func ProxyDialer(proxies []*url.URL, dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+
+		conn, err := dialer.DialContext(ctx, "tcp", proxyAddress(proxies[0]))
+		if err != nil {
+			return nil, err
+		}
+
+		// The handshakes are bounded like the dial itself
+		deadline, ok := ctx.Deadline()
+		if dialer.Timeout > 0 && (!ok || time.Now().Add(dialer.Timeout).Before(deadline)) {
+			deadline = time.Now().Add(dialer.Timeout)
+		}
+		conn.SetDeadline(deadline)
+
+		for i, proxy := range proxies {
+			next := addr
+			if i+1 < len(proxies) {
+				next = proxyAddress(proxies[i+1])
+			}
+			conn, err = tunnel(ctx, conn, proxy, next, dialer.Resolver)
+			if err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("proxy %s: %w", proxy.Host, err)
+			}
+		}
+
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+}
+
+func proxyAddress(proxy *url.URL) string {
+	if proxy.Port() != "" {
+		return proxy.Host
+	}
+	switch proxy.Scheme {
+	case "https":
+		return net.JoinHostPort(proxy.Hostname(), "443")
+	case "socks5", "socks5h":
+		return net.JoinHostPort(proxy.Hostname(), "1080")
+	default:
+		return net.JoinHostPort(proxy.Hostname(), "80")
+	}
+}
+
+// tunnel asks the proxy conn is connected to for a connection to addr.
+func tunnel(ctx context.Context, conn net.Conn, proxy *url.URL, addr string, resolver *net.Resolver) (net.Conn, error) {
+	switch proxy.Scheme {
+	case "https":
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return conn, err
+		}
+		return connectHTTP(tlsConn, proxy, addr)
+	case "socks5", "socks5h":
+		return connectSOCKS5(ctx, conn, proxy, addr, resolver)
+	default:
+		return connectHTTP(conn, proxy, addr)
+	}
+}
+
+// bufferedConn keeps the bytes read ahead while parsing a proxy response.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func connectHTTP(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("CONNECT refused: %s", resp.Status)
+	}
+
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// The SOCKS5 protocol values used, see RFC 1928 and RFC 1929.
+const (
+	socksVersion        = 5
+	socksNoAuth         = 0
+	socksPasswordAuth   = 2
+	socksNoAcceptable   = 0xff
+	socksConnect        = 1
+	socksIPv4           = 1
+	socksDomain         = 3
+	socksIPv6           = 4
+	socksAuthVersion    = 1
+	socksReplySucceeded = 0
+)
+
+func connectSOCKS5(ctx context.Context, conn net.Conn, proxy *url.URL, addr string, resolver *net.Resolver) (net.Conn, error) {
+
+	host, portValue, err := net.SplitHostPort(addr)
+	if err != nil {
+		return conn, err
+	}
+	port, err := strconv.ParseUint(portValue, 10, 16)
+	if err != nil {
+		return conn, fmt.Errorf("invalid port %s", portValue)
+	}
+
+	methods := []byte{socksNoAuth}
+	if proxy.User != nil {
+		methods = []byte{socksNoAuth, socksPasswordAuth}
+	}
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return conn, err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return conn, err
+	}
+	if reply[0] != socksVersion {
+		return conn, errors.New("not a SOCKS5 proxy")
+	}
+	switch reply[1] {
+	case socksNoAuth:
+	case socksPasswordAuth:
+		if proxy.User == nil {
+			return conn, errors.New("SOCKS5 proxy requires credentials")
+		}
+		username := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return conn, errors.New("SOCKS5 credentials too long")
+		}
+		auth := []byte{socksAuthVersion, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return conn, err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return conn, err
+		}
+		if reply[1] != 0 {
+			return conn, errors.New("SOCKS5 authentication failed")
+		}
+	case socksNoAcceptable:
+		return conn, errors.New("no acceptable SOCKS5 authentication method")
+	default:
+		return conn, fmt.Errorf("unsupported SOCKS5 authentication method %d", reply[1])
+	}
+
+	// socks5 resolves the host names locally, socks5h leaves it to the proxy
+	if ip := net.ParseIP(host); ip == nil && proxy.Scheme == "socks5" {
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return conn, err
+		}
+		if len(addrs) == 0 {
+			return conn, fmt.Errorf("no address for %s", host)
+		}
+		host = addrs[0].IP.String()
+	}
+
+	req := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return conn, errors.New("host name too long")
+		}
+		req = append(req, socksDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socksIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socksIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return conn, err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return conn, err
+	}
+	if header[1] != socksReplySucceeded {
+		return conn, fmt.Errorf("SOCKS5 connect failed with code %d", header[1])
+	}
+
+	// Skip the bound address
+	var skip int
+	switch header[3] {
+	case socksIPv4:
+		skip = net.IPv4len
+	case socksIPv6:
+		skip = net.IPv6len
+	case socksDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return conn, err
+		}
+		skip = int(length[0])
+	default:
+		return conn, fmt.Errorf("invalid SOCKS5 address type %d", header[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return conn, err
+	}
+	return conn, nil
+}
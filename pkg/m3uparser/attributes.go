@@ -0,0 +1,92 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package m3uparser
+
+import "strings"
+
+// attributeSpan locates the value of an attribute in an HLS attribute list,
+// e.g. METHOD=AES-128,URI="key.bin", the bounds exclude the quotes.
+func attributeSpan(list, name string) (int, int, bool) {
+
+	i := 0
+	for i < len(list) {
+		eq := strings.IndexByte(list[i:], '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.TrimSpace(list[i : i+eq])
+		i += eq + 1
+
+		var start, end int
+		if i < len(list) && list[i] == '"' {
+			start = i + 1
+			closing := strings.IndexByte(list[start:], '"')
+			if closing < 0 {
+				break
+			}
+			end = start + closing
+			i = end + 1
+		} else {
+			start = i
+			comma := strings.IndexByte(list[start:], ',')
+			if comma < 0 {
+				comma = len(list) - start
+			}
+			end = start + comma
+			i = end
+		}
+
+		if key == name {
+			return start, end, true
+		}
+
+		// Skip the separator
+		if i < len(list) && list[i] == ',' {
+			i++
+		}
+	}
+	return 0, 0, false
+}
+
+// GetAttribute returns the value of an attribute of the tag, quotes removed.
+func (tag *M3UTag) GetAttribute(name string) (string, bool) {
+	start, end, ok := attributeSpan(tag.Value, name)
+	if !ok {
+		return "", false
+	}
+	return tag.Value[start:end], true
+}
+
+// SetAttribute replaces the value of an attribute of the tag, keeping the
+// rest of the attribute list untouched. A missing attribute is appended as a
+// quoted string.
+func (tag *M3UTag) SetAttribute(name, value string) {
+	start, end, ok := attributeSpan(tag.Value, name)
+	if !ok {
+		if tag.Value != "" {
+			tag.Value += ","
+		}
+		tag.Value += name + "=\"" + value + "\""
+		return
+	}
+	tag.Value = tag.Value[:start] + value + tag.Value[end:]
+}
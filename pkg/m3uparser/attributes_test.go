@@ -0,0 +1,65 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package m3uparser
+
+import (
+	"testing"
+)
+
+func TestGetAttribute(t *testing.T) {
+	tag := M3UTag{"EXT-X-MEDIA", "TYPE=AUDIO,GROUP-ID=\"aac\",NAME=\"English, main\",URI=\"audio/en.m3u8\",DEFAULT=YES"}
+
+	tests := map[string]string{
+		"TYPE":     "AUDIO",
+		"GROUP-ID": "aac",
+		"NAME":     "English, main",
+		"URI":      "audio/en.m3u8",
+		"DEFAULT":  "YES",
+	}
+	for name, expected := range tests {
+		value, ok := tag.GetAttribute(name)
+		if !ok || value != expected {
+			t.Errorf("Unexpected attribute %s. Expected: %s, Got: %s", name, expected, value)
+		}
+	}
+
+	if _, ok := tag.GetAttribute("LANGUAGE"); ok {
+		t.Error("Missing attribute should not be found")
+	}
+}
+
+func TestSetAttribute(t *testing.T) {
+	tag := M3UTag{"EXT-X-KEY", "METHOD=AES-128,URI=\"https://keys.example.com/k?id=1,2\",IV=0x1234"}
+
+	tag.SetAttribute("URI", "key.bin?cache=abc")
+	expected := "METHOD=AES-128,URI=\"key.bin?cache=abc\",IV=0x1234"
+	if tag.Value != expected {
+		t.Errorf("Unexpected value. Expected: %s, Got: %s", expected, tag.Value)
+	}
+
+	tag.SetAttribute("KEYFORMAT", "identity")
+	expected += ",KEYFORMAT=\"identity\""
+	if tag.Value != expected {
+		t.Errorf("Unexpected value. Expected: %s, Got: %s", expected, tag.Value)
+	}
+}
@@ -23,6 +23,7 @@ package m3uparser
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"strings"
 )
@@ -145,6 +146,20 @@ func (entry *M3UEntry) AddTag(tag string, value string) {
 	entry.Tags = append(entry.Tags, M3UTag{tag, value})
 }
 
+// SetTvgTag sets a tvg attribute of the entry, rewriting its EXTINF tag so
+// the change is kept when the entry is written.
+func (entry *M3UEntry) SetTvgTag(tag, value string) {
+	entry.TVGTags = entry.TVGTags.SetValue(tag, value)
+	extinf := fmt.Sprintf("%d %s,%s", entry.Duration, strings.TrimSpace(entry.TVGTags.String()), entry.Title)
+	for i := range entry.Tags {
+		if entry.Tags[i].Tag == "EXTINF" {
+			entry.Tags[i].Value = extinf
+			return
+		}
+	}
+	entry.Tags = append([]M3UTag{{"EXTINF", extinf}}, entry.Tags...)
+}
+
 func (entry *M3UEntry) ClearTags() {
 	tags := M3UTags{}
 	for _, tag := range entry.Tags {
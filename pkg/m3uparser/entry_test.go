@@ -47,3 +47,30 @@ func TestParseTag_EmptyLine(t *testing.T) {
 		t.Error("Error should not be nil")
 	}
 }
+
+func TestSetTvgTag(t *testing.T) {
+	entry := M3UEntry{
+		Duration: -1,
+		Title:    "Channel 1",
+		Tags: []M3UTag{
+			{"EXTINF", "-1 tvg-logo=\"logo1.png\",Channel 1"},
+			{"EXTVLCOPT", "http-user-agent=Firefox"},
+		},
+		TVGTags: ParseTVGTags(" tvg-logo=\"logo1.png\",Channel 1"),
+	}
+
+	entry.SetTvgTag("tvg-id", "channel1.pt")
+
+	if entry.TVGTags.GetValue("tvg-id") != "channel1.pt" {
+		t.Errorf("Unexpected tvg-id. Expected: channel1.pt, Got: %s", entry.TVGTags.GetValue("tvg-id"))
+	}
+
+	expectedExtinf := "-1 tvg-logo=\"logo1.png\" tvg-id=\"channel1.pt\",Channel 1"
+	if entry.Tags[0].Value != expectedExtinf {
+		t.Errorf("Unexpected EXTINF. Expected: %s, Got: %s", expectedExtinf, entry.Tags[0].Value)
+	}
+
+	if len(entry.Tags) != 2 {
+		t.Errorf("Unexpected number of tags. Expected: 2, Got: %d", len(entry.Tags))
+	}
+}
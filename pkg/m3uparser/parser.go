@@ -22,12 +22,13 @@ THE SOFTWARE.
 package m3uparser
 
 import (
+	"context"
 	"errors"
 	"io"
-	"net/http"
-	"os"
 	"strconv"
 	"strings"
+
+	"github.com/a13labs/m3uproxy/pkg/fetch"
 )
 
 const (
@@ -59,6 +60,7 @@ var (
 		"EXT-X-MEDIA-SEQUENCE",
 		"EXT-X-MEDIA",
 		"EXT-X-STREAM-INF",
+		"EXT-X-I-FRAME-STREAM-INF",
 		"EXT-X-BYTERANGE",
 		"EXT-X-DISCONTINUITY",
 		"EXT-X-DISCONTINUITY-SEQUENCE",
@@ -71,6 +73,13 @@ var (
 		"EXT-X-SESSION-DATA",
 		"EXT-X-SESSION-KEY",
 		"EXT-X-ENDLIST",
+		// Low-Latency HLS extensions
+		"EXT-X-SERVER-CONTROL",
+		"EXT-X-PART-INF",
+		"EXT-X-PART",
+		"EXT-X-PRELOAD-HINT",
+		"EXT-X-RENDITION-REPORT",
+		"EXT-X-SKIP",
 		// VLC M3U extensions
 		"EXTVLCOPT",
 		// Kodi M3U extensions
@@ -90,32 +99,26 @@ func contains(slice []string, item string) bool {
 }
 
 func ParseM3UFile(filePath string) (*M3UPlaylist, error) {
-	var reader io.ReadCloser
-
-	if strings.HasPrefix(filePath, "http://") || strings.HasPrefix(filePath, "https://") {
-		// Load content from URL
-		resp, err := http.Get(filePath)
-		if err != nil {
-			return nil, err
-		}
-
-		defer resp.Body.Close()
-
-		reader = resp.Body
-
-	} else {
+	return ParseM3USource(filePath, fetch.Config{})
+}
 
-		// Load content from local file
-		file, err := os.Open(filePath)
-		if err != nil {
-			return nil, err
-		}
+// ParseM3USource parses a local or remote playlist, fetching remote ones
+// according to config.
+func ParseM3USource(source string, config fetch.Config) (*M3UPlaylist, error) {
+	return ParseM3USourceContext(context.Background(), source, config)
+}
 
-		defer file.Close()
+// ParseM3USourceContext parses a local or remote playlist, giving up on a
+// remote one once ctx is done.
+func ParseM3USourceContext(ctx context.Context, source string, config fetch.Config) (*M3UPlaylist, error) {
 
-		reader = file
+	reader, err := fetch.OpenContext(ctx, source, config)
+	if err != nil {
+		return nil, err
 	}
 
+	defer reader.Close()
+
 	return DecodeFromReader(reader)
 }
 
@@ -218,6 +221,10 @@ func DecodeFromReader(buf io.Reader) (*M3UPlaylist, error) {
 	// Read all content from buf
 	var currentEntry *M3UEntry
 
+	// Tags found between two entries belong to the next one, e.g. key
+	// rotations or discontinuities of a media playlist
+	var pendingTags []M3UTag
+
 	for {
 
 		tag, line, err := processLine(buf)
@@ -242,8 +249,9 @@ func DecodeFromReader(buf io.Reader) (*M3UPlaylist, error) {
 		if tag.Tag == "EXTINF" {
 			// Handle EXTINF tag
 			currentEntry = &M3UEntry{
-				Tags: []M3UTag{tag},
+				Tags: append(pendingTags, tag),
 			}
+			pendingTags = nil
 			parts := strings.SplitN(tag.Value, ",", 2)
 			if len(parts) > 0 {
 				currentEntry.Duration = parseDuration(parts[0])
@@ -261,13 +269,16 @@ func DecodeFromReader(buf io.Reader) (*M3UPlaylist, error) {
 
 		if tag.Tag == "EXT-X-STREAM-INF" {
 			currentEntry = &M3UEntry{
-				Tags: []M3UTag{tag}, // Add the EXT-X-STREAM-INF tag
+				Tags: append(pendingTags, tag), // Add the EXT-X-STREAM-INF tag
 			}
+			pendingTags = nil
 			continue
 		}
 
 		if currentEntry != nil {
 			currentEntry.Tags = append(currentEntry.Tags, tag)
+		} else if len(playlist.Entries) > 0 {
+			pendingTags = append(pendingTags, tag)
 		} else {
 
 			if tag.Tag == "EXT-X-INDEPENDENT-SEGMENTS" {
@@ -281,6 +292,8 @@ func DecodeFromReader(buf io.Reader) (*M3UPlaylist, error) {
 
 	}
 
+	playlist.Trailer = pendingTags
+
 	if playlist.Version == 0 {
 		return nil, errors.New("invalid M3U file")
 	}
@@ -25,6 +25,7 @@ package m3uparser
 import (
 	"io"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -210,6 +211,42 @@ func TestParseM3UFile2(t *testing.T) {
 	}
 }
 
+func TestParseSegmentTags(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-MEDIA-SEQUENCE:1
+#EXT-X-KEY:METHOD=AES-128,URI="key1.bin"
+#EXTINF:10,
+segment1.ts
+#EXT-X-DISCONTINUITY:
+#EXT-X-KEY:METHOD=AES-128,URI="key2.bin"
+#EXTINF:10,
+segment2.ts
+#EXT-X-ENDLIST:`
+
+	playlist, err := DecodeFromReader(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Failed to parse M3U: %v", err)
+	}
+
+	if len(playlist.Entries) != 2 {
+		t.Fatalf("Unexpected number of entries. Expected: 2, Got: %d", len(playlist.Entries))
+	}
+
+	key := playlist.Entries[1].SearchTags("EXT-X-KEY")
+	if len(key) != 1 || key[0].Value != "METHOD=AES-128,URI=\"key2.bin\"" {
+		t.Errorf("Key rotation should belong to the second entry, got: %v", playlist.Entries[1].Tags)
+	}
+
+	if len(playlist.Trailer) != 1 || playlist.Trailer[0].Tag != "EXT-X-ENDLIST" {
+		t.Errorf("Unexpected trailer: %v", playlist.Trailer)
+	}
+
+	if playlist.String() != content {
+		t.Errorf("Unexpected content. Expected: %s, Got: %s", content, playlist.String())
+	}
+}
+
 func TestParseDuration(t *testing.T) {
 	durationStr := "123"
 	expectedDuration := 123
@@ -31,6 +31,7 @@ type M3UPlaylist struct {
 	Version int        // The version of the M3U (EXTM3U).
 	Entries M3UEntries // The list of media entries in the playlist.
 	Tags    M3UTags    // Additional tags associated with the entry.
+	Trailer M3UTags    // The tags following the last entry.
 	Type    string     // The type of the media (if available).
 }
 
@@ -50,6 +51,9 @@ func (playlist *M3UPlaylist) EntriesString() string {
 	for _, entry := range playlist.Entries {
 		result += entry.String() + "\n"
 	}
+	for _, tag := range playlist.Trailer {
+		result += "#" + tag.Tag + ":" + tag.Value + "\n"
+	}
 	return strings.Trim(result, "\n")
 }
 
@@ -73,6 +77,10 @@ func (playlist *M3UPlaylist) WriteTo(writer io.Writer) (int64, error) {
 		nBytes, _ := entry.WriteTo(writer)
 		n += int(nBytes)
 	}
+	for _, tag := range playlist.Trailer {
+		nBytes, _ := writer.Write([]byte("#" + tag.Tag + ":" + tag.Value + "\n"))
+		n += nBytes
+	}
 	return int64(n), err
 }
 
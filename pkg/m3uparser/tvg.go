@@ -74,6 +74,18 @@ func (tags M3UTvgTags) GetValue(tag string) string {
 	return ""
 }
 
+// SetValue returns the tags with the value of tag replaced, or appended when
+// the tag is not present.
+func (tags M3UTvgTags) SetValue(tag, value string) M3UTvgTags {
+	for i, t := range tags {
+		if t.Tag == tag {
+			tags[i].Value = value
+			return tags
+		}
+	}
+	return append(tags, M3UTvgTag{Tag: tag, Value: value})
+}
+
 func (tags M3UTvgTags) String() string {
 	var result string
 	for _, tag := range tags {
@@ -23,15 +23,21 @@ package m3uprovider
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+
+	"github.com/a13labs/m3uproxy/pkg/fetch"
 )
 
 type OverrideEntry struct {
 	ChannelName      string            `json:"name,omitempty"`
+	TvgID            string            `json:"tvg_id,omitempty"`
+	StreamID         string            `json:"stream_id,omitempty"`
 	URL              string            `json:"url,omitempty"`
 	Headers          map[string]string `json:"headers,omitempty"`
 	Disabled         bool              `json:"disabled,omitempty"`
 	HttpProxy        string            `json:"http_proxy,omitempty"`
+	ProxyPool        string            `json:"proxy_pool,omitempty"`
 	ForceKodiHeaders bool              `json:"kodi,omitempty"`
 	DisableRemap     bool              `json:"disable_remap,omitempty"`
 }
@@ -39,6 +45,12 @@ type OverrideEntry struct {
 type ProviderConfig struct {
 	Provider string          `json:"provider"`
 	Config   json.RawMessage `json:"config"`
+	// StreamProxy is the proxy, or comma separated chain of proxies, the
+	// channels of the provider are streamed through.
+	StreamProxy string `json:"stream_proxy,omitempty"`
+	// StreamProxyPool is the name of the proxy pool, set in the server
+	// configuration, used instead of StreamProxy.
+	StreamProxyPool string `json:"stream_proxy_pool,omitempty"`
 }
 
 type PlaylistConfig struct {
@@ -71,7 +83,7 @@ func (c *PlaylistConfig) SaveToFile(file string) error {
 		return err
 	}
 
-	f, err := os.OpenFile(file, os.O_RDWR|os.O_TRUNC, 0644)
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
@@ -86,9 +98,37 @@ func (c *PlaylistConfig) SaveToFile(file string) error {
 	return nil
 }
 
+// Validate fetches every provider of the configuration without touching the
+// providers state kept by Load.
 func (c *PlaylistConfig) Validate() bool {
-	_, err := Load(c)
-	return err == nil
+	if c.validateProxies() != nil {
+		return false
+	}
+	priority, err := providersPriority(c)
+	if err != nil {
+		return false
+	}
+	for _, result := range fetchProviders(c, priority) {
+		if result.playlist == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// validateProxies checks the stream proxies of the providers and channels.
+func (c *PlaylistConfig) validateProxies() error {
+	for name, provider := range c.Providers {
+		if _, err := fetch.ParseProxies(provider.StreamProxy); err != nil {
+			return fmt.Errorf("provider '%s': %w", name, err)
+		}
+	}
+	for id, override := range c.Overrides {
+		if _, err := fetch.ParseProxies(override.HttpProxy); err != nil {
+			return fmt.Errorf("channel '%s': %w", id, err)
+		}
+	}
+	return nil
 }
 
 func LoadPlaylistConfig(path string) (*PlaylistConfig, error) {
@@ -105,5 +145,9 @@ func LoadPlaylistConfig(path string) (*PlaylistConfig, error) {
 		return nil, err
 	}
 
+	if err := config.validateProxies(); err != nil {
+		return nil, err
+	}
+
 	return &config, nil
 }
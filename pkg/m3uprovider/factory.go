@@ -22,8 +22,14 @@ THE SOFTWARE.
 package m3uprovider
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/a13labs/m3uproxy/pkg/m3uparser"
 	"github.com/a13labs/m3uproxy/pkg/m3uprovider/file"
@@ -31,30 +37,149 @@ import (
 	types "github.com/a13labs/m3uproxy/pkg/m3uprovider/types"
 )
 
-func NewProvider(config ProviderConfig) types.M3UProvider {
+func isKnownProvider(provider string) bool {
+	switch provider {
+	case "iptv.org", "file":
+		return true
+	default:
+		return false
+	}
+}
+
+func NewProvider(ctx context.Context, config ProviderConfig) types.M3UProvider {
 
 	switch config.Provider {
 	case "iptv.org":
-		return iptvorg.NewIPTVOrgProvider(config.Config)
+		if p := iptvorg.NewIPTVOrgProvider(ctx, config.Config); p != nil {
+			return p
+		}
+		return nil
 	case "file":
-		return file.NewM3UFileProvider(config.Config)
+		if p := file.NewM3UFileProvider(ctx, config.Config); p != nil {
+			return p
+		}
+		return nil
 	default:
 		return nil
 	}
 }
 
-func Load(config *PlaylistConfig) (*m3uparser.M3UPlaylist, error) {
+type fetchResult struct {
+	playlist *m3uparser.M3UPlaylist
+	stats    ProviderStats
+}
+
+// fetchProvider builds a provider. Timeouts and retries are those of the
+// fetch options of the provider source.
+func fetchProvider(name string, config ProviderConfig) (result fetchResult) {
+
+	result = fetchResult{
+		stats: ProviderStats{
+			Name:     name,
+			Provider: config.Provider,
+		},
+	}
 
-	providersPriority := make([]string, 0)
+	start := time.Now()
+	defer func() {
+		result.stats.DurationMs = time.Since(start).Milliseconds()
+	}()
+
+	provider := NewProvider(context.Background(), config)
+	if provider == nil {
+		result.stats.Error = "failed to load provider"
+		log.Printf("Provider '%s' failed: %s\n", name, result.stats.Error)
+		return result
+	}
+
+	result.playlist = provider.GetPlaylist()
+	result.stats.Entries = len(result.playlist.Entries)
+	return result
+}
+
+func providersPriority(config *PlaylistConfig) ([]string, error) {
+
+	priority := make([]string, 0)
 	if config.ProvidersPriority != nil {
 		if len(config.ProvidersPriority) != len(config.Providers) {
 			return nil, errors.New("providers_priority and providers must have the same length")
 		}
-		providersPriority = append(providersPriority, config.ProvidersPriority...)
+		priority = append(priority, config.ProvidersPriority...)
 	} else {
 		for providerName := range config.Providers {
-			providersPriority = append(providersPriority, providerName)
+			priority = append(priority, providerName)
 		}
+		sort.Strings(priority)
+	}
+
+	for _, providerName := range priority {
+		providerConfig, ok := config.Providers[providerName]
+		if !ok || !isKnownProvider(providerConfig.Provider) {
+			return nil, errors.New("provider not available '" + providerName + "'")
+		}
+	}
+
+	return priority, nil
+}
+
+// fetchProviders fetches the given providers concurrently.
+func fetchProviders(config *PlaylistConfig, names []string) []fetchResult {
+
+	results := make([]fetchResult, len(names))
+	var wg sync.WaitGroup
+	for i, providerName := range names {
+		wg.Add(1)
+		go func(i int, providerName string) {
+			defer wg.Done()
+			log.Printf("Provider: %s\n", providerName)
+			results[i] = fetchProvider(providerName, config.Providers[providerName])
+		}(i, providerName)
+	}
+	wg.Wait()
+	return results
+}
+
+func Load(config *PlaylistConfig) (*m3uparser.M3UPlaylist, error) {
+
+	priority, err := providersPriority(config)
+	if err != nil {
+		return nil, err
+	}
+
+	pruneProviderState(config)
+	return load(config, priority, priority)
+}
+
+// Refresh fetches a single provider again and merges it with the last
+// playlists fetched from the other providers.
+func Refresh(config *PlaylistConfig, name string) (*m3uparser.M3UPlaylist, error) {
+
+	priority, err := providersPriority(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := config.Providers[name]; !ok {
+		return nil, fmt.Errorf("provider '%s' not found", name)
+	}
+
+	return load(config, priority, []string{name})
+}
+
+// load fetches the providers in refresh, plus any provider without a cached
+// playlist for its current configuration, and merges everything in priority
+// order. Providers that fail to fetch fall back to their cached playlist.
+func load(config *PlaylistConfig, priority []string, refresh []string) (*m3uparser.M3UPlaylist, error) {
+
+	toFetch := make([]string, 0, len(priority))
+	for _, providerName := range priority {
+		if contains(refresh, providerName) || getCachedPlaylist(providerName, config.Providers[providerName]) == nil {
+			toFetch = append(toFetch, providerName)
+		}
+	}
+
+	for _, result := range fetchProviders(config, toFetch) {
+		updateProviderState(config.Providers[result.stats.Name], result)
 	}
 
 	masterPlaylist := m3uparser.M3UPlaylist{
@@ -63,65 +188,23 @@ func Load(config *PlaylistConfig) (*m3uparser.M3UPlaylist, error) {
 		Tags:    make(m3uparser.M3UTags, 0),
 	}
 
-	for _, providerName := range providersPriority {
-
-		provider := NewProvider(config.Providers[providerName])
-		if provider == nil {
-			return nil, errors.New("provider not available '" + providerName + "'")
+	failed := make([]string, 0)
+	for _, providerName := range priority {
+		playlist := getCachedPlaylist(providerName, config.Providers[providerName])
+		if playlist == nil {
+			failed = append(failed, providerName)
+			continue
 		}
 
-		log.Printf("Provider: %s\n", providerName)
-		playlist := provider.GetPlaylist()
-		for _, entry := range playlist.Entries {
-			tvgId := entry.TVGTags.GetValue("tvg-id")
-			if tvgId == "" {
-				tvgId = entry.Title
-			}
-			if masterPlaylist.SearchEntryByTvgTag("tvg-id", tvgId) != nil {
-				log.Printf("Duplicate entry: '%s', skipping.", entry.Title)
-				continue
-			}
-
-			override, ok := config.Overrides[tvgId]
-			if ok && override.Disabled {
-				log.Printf("Channel '%s' is disabled, skipping.", entry.Title)
-				continue
-			}
-			if ok && override.ChannelName != "" {
-				entry.Title = override.ChannelName
-			}
-			if ok && override.URL != "" {
-				entry.URI = override.URL
-			}
-			if ok && len(override.Headers) > 0 {
-				for k, v := range override.Headers {
-					entry.Tags = append(entry.Tags, m3uparser.M3UTag{
-						Tag:   "M3UPROXYHEADER",
-						Value: k + "=" + v,
-					})
-				}
-			}
-			if ok && override.HttpProxy != "" {
-				entry.Tags = append(entry.Tags, m3uparser.M3UTag{
-					Tag:   "M3UPROXYTRANSPORT",
-					Value: "proxy=" + override.HttpProxy,
-				})
-			}
-			if ok && override.ForceKodiHeaders {
-				entry.Tags = append(entry.Tags, m3uparser.M3UTag{
-					Tag:   "M3UPROXYOPT",
-					Value: "forcekodiheaders",
-				})
-			}
-			if ok && override.DisableRemap {
-				entry.Tags = append(entry.Tags, m3uparser.M3UTag{
-					Tag:   "M3UPROXYOPT",
-					Value: "disableremap",
-				})
-			}
-			masterPlaylist.Entries = append(masterPlaylist.Entries, entry)
-		}
+		stats := ProviderStats{Entries: len(playlist.Entries)}
+		mergeProvider(config, providerName, &masterPlaylist, playlist, &stats)
+		updateMergeStats(providerName, stats)
+		log.Printf("Provider '%s': %d entries, %d merged, %d duplicates, %d disabled\n",
+			providerName, stats.Entries, stats.Merged, stats.Duplicates, stats.Disabled)
+	}
 
+	if len(failed) > 0 {
+		return nil, fmt.Errorf("failed to load providers: %s", strings.Join(failed, ", "))
 	}
 
 	if len(config.ChannelOrder) > 0 {
@@ -143,6 +226,96 @@ func Load(config *PlaylistConfig) (*m3uparser.M3UPlaylist, error) {
 	return &masterPlaylist, nil
 }
 
+func mergeProvider(config *PlaylistConfig, providerName string, masterPlaylist *m3uparser.M3UPlaylist, playlist *m3uparser.M3UPlaylist, stats *ProviderStats) {
+
+	for _, entry := range playlist.Entries {
+		tvgId := entry.TVGTags.GetValue("tvg-id")
+		if tvgId == "" {
+			tvgId = entry.Title
+		}
+		if masterPlaylist.SearchEntryByTvgTag("tvg-id", tvgId) != nil {
+			log.Printf("Duplicate entry: '%s', skipping.", entry.Title)
+			stats.Duplicates++
+			continue
+		}
+
+		// The provider playlist is cached and merged again on every refresh,
+		// the entry tags are copied so the overrides do not alter it.
+		entry.Tags = append(make(m3uparser.M3UTags, 0, len(entry.Tags)), entry.Tags...)
+		entry.TVGTags = append(make(m3uparser.M3UTvgTags, 0, len(entry.TVGTags)), entry.TVGTags...)
+
+		override, ok := config.Overrides[tvgId]
+		if ok && override.Disabled {
+			log.Printf("Channel '%s' is disabled, skipping.", entry.Title)
+			stats.Disabled++
+			continue
+		}
+		if ok && override.ChannelName != "" {
+			entry.Title = override.ChannelName
+		}
+		if ok && override.TvgID != "" && override.TvgID != tvgId {
+			if masterPlaylist.SearchEntryByTvgTag("tvg-id", override.TvgID) != nil {
+				log.Printf("Duplicate entry: '%s', skipping.", entry.Title)
+				stats.Duplicates++
+				continue
+			}
+			entry.SetTvgTag("tvg-id", override.TvgID)
+		}
+		if ok && override.URL != "" {
+			entry.URI = override.URL
+		}
+		if ok && len(override.Headers) > 0 {
+			for k, v := range override.Headers {
+				entry.Tags = append(entry.Tags, m3uparser.M3UTag{
+					Tag:   "M3UPROXYHEADER",
+					Value: k + "=" + v,
+				})
+			}
+		}
+		if ok && override.StreamID != "" {
+			entry.Tags = append(entry.Tags, m3uparser.M3UTag{
+				Tag:   "M3UPROXYID",
+				Value: override.StreamID,
+			})
+		}
+		transport := ""
+		if provider := config.Providers[providerName]; provider.StreamProxyPool != "" {
+			transport = "pool=" + provider.StreamProxyPool
+		} else if provider.StreamProxy != "" {
+			transport = "proxy=" + provider.StreamProxy
+		}
+		if ok && override.ProxyPool != "" {
+			transport = "pool=" + override.ProxyPool
+		} else if ok && override.HttpProxy != "" {
+			transport = "proxy=" + override.HttpProxy
+		}
+		if transport != "" {
+			entry.Tags = append(entry.Tags, m3uparser.M3UTag{
+				Tag:   "M3UPROXYTRANSPORT",
+				Value: transport,
+			})
+		}
+		if ok && override.ForceKodiHeaders {
+			entry.Tags = append(entry.Tags, m3uparser.M3UTag{
+				Tag:   "M3UPROXYOPT",
+				Value: "forcekodiheaders",
+			})
+		}
+		if ok && override.DisableRemap {
+			entry.Tags = append(entry.Tags, m3uparser.M3UTag{
+				Tag:   "M3UPROXYOPT",
+				Value: "disableremap",
+			})
+		}
+		entry.Tags = append(entry.Tags, m3uparser.M3UTag{
+			Tag:   "M3UPROXYPROVIDER",
+			Value: providerName,
+		})
+		masterPlaylist.Entries = append(masterPlaylist.Entries, entry)
+		stats.Merged++
+	}
+}
+
 func LoadFromFile(path string) (*m3uparser.M3UPlaylist, error) {
 
 	config, err := LoadPlaylistConfig(path)
@@ -22,15 +22,18 @@ THE SOFTWARE.
 package file
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 
+	"github.com/a13labs/m3uproxy/pkg/fetch"
 	"github.com/a13labs/m3uproxy/pkg/m3uparser"
 	"github.com/a13labs/m3uproxy/pkg/m3uprovider/types"
 )
 
 type M3UFileConfig struct {
 	Source string `json:"source"`
+	fetch.Config
 }
 
 type M3UFileProvider struct {
@@ -38,7 +41,7 @@ type M3UFileProvider struct {
 	playlist m3uparser.M3UPlaylist
 }
 
-func NewM3UFileProvider(config json.RawMessage) *M3UFileProvider {
+func NewM3UFileProvider(ctx context.Context, config json.RawMessage) *M3UFileProvider {
 
 	cfg := M3UFileConfig{}
 	err := json.Unmarshal([]byte(config), &cfg)
@@ -47,8 +50,13 @@ func NewM3UFileProvider(config json.RawMessage) *M3UFileProvider {
 		return nil
 	}
 
+	if err := cfg.Validate(); err != nil {
+		log.Printf("Invalid config: %s", err)
+		return nil
+	}
+
 	log.Printf("Parsing M3U file: %s", cfg.Source)
-	playlist, err := m3uparser.ParseM3UFile(cfg.Source)
+	playlist, err := m3uparser.ParseM3USourceContext(ctx, cfg.Source, cfg.Config)
 	if err != nil {
 		log.Printf("Error parsing M3U file: %s", err)
 		return nil
@@ -22,6 +22,7 @@ THE SOFTWARE.
 package iptvorg
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -80,9 +81,18 @@ func contains(s []string, e string) bool {
 	return false
 }
 
-func getChannels(config IPTVOrgConfig) (map[string]cachedEntry, error) {
+// get requests an API endpoint, the request is abandoned once ctx is done.
+func get(ctx context.Context, endpoint string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, IPTV_API_URL+endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func getChannels(ctx context.Context, config IPTVOrgConfig) (map[string]cachedEntry, error) {
 
-	resp, err := http.Get(IPTV_API_URL + "/channels.json")
+	resp, err := get(ctx, "/channels.json")
 	if err != nil {
 		log.Printf("Error getting channels: %s", err)
 		return nil, err
@@ -126,9 +136,9 @@ func getChannels(config IPTVOrgConfig) (map[string]cachedEntry, error) {
 	return channels, nil
 }
 
-func getStreams(channels map[string]cachedEntry, config IPTVOrgConfig) ([]m3uparser.M3UEntry, error) {
+func getStreams(ctx context.Context, channels map[string]cachedEntry, config IPTVOrgConfig) ([]m3uparser.M3UEntry, error) {
 
-	resp, err := http.Get(IPTV_API_URL + "/streams.json")
+	resp, err := get(ctx, "/streams.json")
 
 	if err != nil {
 		log.Printf("Error getting streams: %s", err)
@@ -251,7 +261,7 @@ func (p *IPTVOrgProvider) GetPlaylist() *m3uparser.M3UPlaylist {
 	return &p.playlist
 }
 
-func NewIPTVOrgProvider(config json.RawMessage) *IPTVOrgProvider {
+func NewIPTVOrgProvider(ctx context.Context, config json.RawMessage) *IPTVOrgProvider {
 
 	cfg := IPTVOrgConfig{}
 	err := json.Unmarshal([]byte(config), &cfg)
@@ -268,14 +278,14 @@ func NewIPTVOrgProvider(config json.RawMessage) *IPTVOrgProvider {
 	}
 
 	log.Println("Getting channels from iptv.org")
-	channels, err := getChannels(cfg)
+	channels, err := getChannels(ctx, cfg)
 	if err != nil {
 		log.Println("Error getting channels")
 		return nil
 	}
 
 	log.Println("Getting streams from iptv.org")
-	streams, err := getStreams(channels, cfg)
+	streams, err := getStreams(ctx, channels, cfg)
 	if err != nil {
 		log.Println("Error getting streams")
 		return nil
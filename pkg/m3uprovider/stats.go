@@ -0,0 +1,161 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package m3uprovider
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/a13labs/m3uproxy/pkg/m3uparser"
+)
+
+// ProviderStats describes the outcome of fetching and merging one provider.
+type ProviderStats struct {
+	Name       string `json:"name"`
+	Provider   string `json:"provider"`
+	DurationMs int64  `json:"duration_ms"`
+	Entries    int    `json:"entries"`
+	Merged     int    `json:"merged"`
+	Duplicates int    `json:"duplicates"`
+	Disabled   int    `json:"disabled"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ProviderStatus is the state of a provider across fetches.
+type ProviderStatus struct {
+	ProviderStats
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	LastFailure time.Time `json:"last_failure,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+type providerState struct {
+	config   ProviderConfig
+	playlist *m3uparser.M3UPlaylist
+	status   ProviderStatus
+}
+
+var (
+	providersState      = make(map[string]*providerState)
+	providersStateMutex sync.Mutex
+)
+
+func contains(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
+
+func updateProviderState(config ProviderConfig, result fetchResult) {
+	providersStateMutex.Lock()
+	defer providersStateMutex.Unlock()
+
+	state, ok := providersState[result.stats.Name]
+	if !ok || !reflect.DeepEqual(state.config, config) {
+		state = &providerState{config: config}
+		providersState[result.stats.Name] = state
+	}
+
+	state.status.Name = result.stats.Name
+	state.status.Provider = result.stats.Provider
+	state.status.DurationMs = result.stats.DurationMs
+	state.status.Error = result.stats.Error
+
+	if result.playlist != nil {
+		state.playlist = result.playlist
+		state.status.Entries = result.stats.Entries
+		state.status.LastSuccess = time.Now()
+	} else {
+		state.status.LastFailure = time.Now()
+		state.status.LastError = result.stats.Error
+	}
+}
+
+// pruneProviderState drops the state of providers no longer configured.
+func pruneProviderState(config *PlaylistConfig) {
+	providersStateMutex.Lock()
+	defer providersStateMutex.Unlock()
+
+	for name := range providersState {
+		if _, ok := config.Providers[name]; !ok {
+			delete(providersState, name)
+		}
+	}
+}
+
+func updateMergeStats(name string, stats ProviderStats) {
+	providersStateMutex.Lock()
+	defer providersStateMutex.Unlock()
+
+	if state, ok := providersState[name]; ok {
+		state.status.Entries = stats.Entries
+		state.status.Merged = stats.Merged
+		state.status.Duplicates = stats.Duplicates
+		state.status.Disabled = stats.Disabled
+	}
+}
+
+// getCachedPlaylist returns the last playlist fetched for a provider, as long
+// as it was fetched with the same configuration.
+func getCachedPlaylist(name string, config ProviderConfig) *m3uparser.M3UPlaylist {
+	providersStateMutex.Lock()
+	defer providersStateMutex.Unlock()
+
+	state, ok := providersState[name]
+	if !ok || !reflect.DeepEqual(state.config, config) {
+		return nil
+	}
+	return state.playlist
+}
+
+// GetProvidersStatus returns the state of every provider fetched so far,
+// sorted by name.
+func GetProvidersStatus() []ProviderStatus {
+	providersStateMutex.Lock()
+	defer providersStateMutex.Unlock()
+
+	status := make([]ProviderStatus, 0, len(providersState))
+	for _, state := range providersState {
+		status = append(status, state.status)
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Name < status[j].Name
+	})
+	return status
+}
+
+// GetProviderStatus returns the state of a single provider.
+func GetProviderStatus(name string) (ProviderStatus, bool) {
+	providersStateMutex.Lock()
+	defer providersStateMutex.Unlock()
+
+	state, ok := providersState[name]
+	if !ok {
+		return ProviderStatus{}, false
+	}
+	return state.status, true
+}
@@ -0,0 +1,61 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package mpegts
+
+// PacketSize is the size of a MPEG transport stream packet.
+const PacketSize = 188
+
+// SyncByte starts every transport stream packet.
+const SyncByte = 0x47
+
+// PID returns the packet identifier of a packet.
+func PID(packet []byte) uint16 {
+	return uint16(packet[1]&0x1f)<<8 | uint16(packet[2])
+}
+
+// hasAdaptationField tells whether a packet carries a non empty adaptation
+// field, where the discontinuity indicator and the PCR are stored.
+func hasAdaptationField(packet []byte) bool {
+	return packet[3]&0x20 != 0 && packet[4] > 0
+}
+
+// MarkDiscontinuity sets the discontinuity indicator on the first packet of
+// each PID carrying an adaptation field, telling the decoders the timestamps
+// and the continuity counters of the stream restart. Data which is not
+// aligned on packets is left as is.
+func MarkDiscontinuity(data []byte) {
+
+	marked := make(map[uint16]bool)
+	for i := 0; i+PacketSize <= len(data); i += PacketSize {
+		packet := data[i : i+PacketSize]
+		if packet[0] != SyncByte {
+			return
+		}
+
+		pid := PID(packet)
+		if marked[pid] || !hasAdaptationField(packet) {
+			continue
+		}
+		packet[5] |= 0x80
+		marked[pid] = true
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package mpegts
+
+import (
+	"testing"
+)
+
+func newPacket(pid uint16, adaptation bool) []byte {
+	packet := make([]byte, PacketSize)
+	packet[0] = SyncByte
+	packet[1] = byte(pid >> 8)
+	packet[2] = byte(pid)
+	packet[3] = 0x10
+	if adaptation {
+		packet[3] |= 0x20
+		packet[4] = 7
+	}
+	return packet
+}
+
+func TestMarkDiscontinuity(t *testing.T) {
+	var data []byte
+	data = append(data, newPacket(0, false)...)
+	data = append(data, newPacket(256, true)...)
+	data = append(data, newPacket(256, true)...)
+	data = append(data, newPacket(257, true)...)
+
+	MarkDiscontinuity(data)
+
+	expected := []bool{false, true, false, true}
+	for i, marked := range expected {
+		packet := data[i*PacketSize : (i+1)*PacketSize]
+		if (packet[5]&0x80 != 0) != marked {
+			t.Errorf("Unexpected discontinuity indicator on packet %d. Expected: %v", i, marked)
+		}
+	}
+}
+
+func TestMarkDiscontinuityUnaligned(t *testing.T) {
+	data := append([]byte{0x00}, newPacket(256, true)...)
+	MarkDiscontinuity(data)
+	if data[6]&0x80 != 0 {
+		t.Error("Unaligned data should be left untouched")
+	}
+}
@@ -0,0 +1,361 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package mpegts
+
+import (
+	"bytes"
+	"time"
+)
+
+const (
+	// ptsClock is the frequency of the presentation timestamps.
+	ptsClock = 90000
+	// ptsWrap is where the 33 bits presentation timestamps wrap around.
+	ptsWrap = 1 << 33
+	// maxPTSJump is the largest gap between two timestamps of the same
+	// stream not considered a discontinuity.
+	maxPTSJump = 10 * ptsClock
+	// forcedCutFactor bounds the duration of segments, as a multiple of
+	// the target, when no keyframe can be found.
+	forcedCutFactor = 3
+)
+
+// videoStreamTypes are the PMT stream types of MPEG-1, MPEG-2, MPEG-4, H.264
+// and H.265 video.
+var videoStreamTypes = map[byte]bool{
+	0x01: true,
+	0x02: true,
+	0x10: true,
+	0x1b: true,
+	0x24: true,
+}
+
+// Segment is a part of a transport stream which can be decoded on its own:
+// it starts with the PAT and the PMT, followed by a keyframe.
+type Segment struct {
+	Data          []byte
+	Duration      time.Duration
+	Discontinuity bool
+}
+
+// Segmenter splits a transport stream in segments of about a target
+// duration, cut at keyframes of the video stream, or of the first stream of
+// the program when it has no video.
+type Segmenter struct {
+	target time.Duration
+	emit   func(Segment)
+
+	partial []byte
+	pat     []byte
+	pmt     []byte
+	pmtPID  int
+
+	timingPID  int
+	streamType byte
+	video      bool
+
+	waiting       time.Time
+	started       bool
+	current       []byte
+	startPTS      int64
+	lastPTS       int64
+	startTime     time.Time
+	discontinuity bool
+}
+
+// NewSegmenter returns a segmenter calling emit with each segment completed.
+func NewSegmenter(target time.Duration, emit func(Segment)) *Segmenter {
+	return &Segmenter{
+		target:    target,
+		emit:      emit,
+		pmtPID:    -1,
+		timingPID: -1,
+		startPTS:  -1,
+		lastPTS:   -1,
+	}
+}
+
+// Write feeds the segmenter with the stream, which does not need to be
+// aligned on packets.
+func (s *Segmenter) Write(data []byte) (int, error) {
+
+	n := len(data)
+	if len(s.partial) > 0 {
+		data = append(s.partial, data...)
+		s.partial = nil
+	}
+
+	for len(data) >= PacketSize {
+		if data[0] != SyncByte {
+			// Lost synchronization, skip to the next sync byte
+			i := bytes.IndexByte(data[1:], SyncByte)
+			if i < 0 {
+				data = nil
+				break
+			}
+			data = data[i+1:]
+			continue
+		}
+		s.packet(data[:PacketSize])
+		data = data[PacketSize:]
+	}
+
+	s.partial = append([]byte(nil), data...)
+	return n, nil
+}
+
+// Flush emits the segment in progress.
+func (s *Segmenter) Flush() {
+	if s.started && len(s.current) > 0 {
+		s.cut(s.elapsed(s.lastPTS))
+	}
+}
+
+func (s *Segmenter) packet(packet []byte) {
+
+	pid := int(PID(packet))
+	start := packet[1]&0x40 != 0
+	payload := payloadOf(packet)
+
+	switch {
+	case pid == 0:
+		if start {
+			s.parsePAT(payload)
+		}
+		s.pat = append(s.pat[:0], packet...)
+	case pid == s.pmtPID:
+		if start {
+			s.parsePMT(payload)
+		}
+		s.pmt = append(s.pmt[:0], packet...)
+	case pid == s.timingPID && start:
+		s.boundary(packet, payload)
+	}
+
+	if s.started {
+		s.current = append(s.current, packet...)
+	}
+}
+
+// boundary handles the start of a PES packet of the timing stream, where
+// segments may be cut.
+func (s *Segmenter) boundary(packet, payload []byte) {
+
+	pts, hasPTS := parsePTS(payload)
+	keyframe := !s.video || randomAccess(packet) || isKeyframe(s.streamType, payload)
+
+	if !s.started {
+		if s.waiting.IsZero() {
+			s.waiting = time.Now()
+		}
+		if keyframe || time.Since(s.waiting) >= forcedCutFactor*s.target {
+			s.begin(pts, hasPTS)
+		}
+		return
+	}
+
+	if hasPTS && s.lastPTS >= 0 {
+		// B-frames make timestamps go back a little
+		delta := (pts - s.lastPTS + ptsWrap) % ptsWrap
+		if delta > ptsWrap/2 {
+			delta = ptsWrap - delta
+		}
+		if delta > maxPTSJump {
+			// Timestamps jumped, the next segment restarts the timeline
+			s.cut(s.elapsed(s.lastPTS))
+			s.discontinuity = true
+			s.begin(pts, hasPTS)
+			return
+		}
+	}
+
+	elapsed := s.elapsed(pts)
+	if hasPTS {
+		s.lastPTS = pts
+	}
+
+	if (keyframe && elapsed >= s.target) || elapsed >= forcedCutFactor*s.target {
+		s.cut(elapsed)
+		s.begin(pts, hasPTS)
+	}
+}
+
+// begin starts a segment with the last PAT and PMT.
+func (s *Segmenter) begin(pts int64, hasPTS bool) {
+	s.started = true
+	s.current = make([]byte, 0, len(s.pat)+len(s.pmt))
+	s.current = append(s.current, s.pat...)
+	s.current = append(s.current, s.pmt...)
+	s.startTime = time.Now()
+	s.startPTS, s.lastPTS = -1, -1
+	if hasPTS {
+		s.startPTS, s.lastPTS = pts, pts
+	}
+}
+
+func (s *Segmenter) cut(duration time.Duration) {
+	s.emit(Segment{
+		Data:          s.current,
+		Duration:      duration,
+		Discontinuity: s.discontinuity,
+	})
+	s.current = nil
+	s.discontinuity = false
+}
+
+// elapsed is the duration of the segment in progress, using the wall clock
+// when the stream has no timestamps.
+func (s *Segmenter) elapsed(pts int64) time.Duration {
+	if s.startPTS < 0 || pts < 0 {
+		return time.Since(s.startTime)
+	}
+	ticks := (pts - s.startPTS + ptsWrap) % ptsWrap
+	if ticks > ptsWrap/2 {
+		// A B-frame presented before the start of the segment
+		return 0
+	}
+	return time.Duration(ticks) * time.Second / ptsClock
+}
+
+func (s *Segmenter) parsePAT(payload []byte) {
+	section := psiSection(payload, 0x00)
+	for i := 8; i+4 <= len(section); i += 4 {
+		program := int(section[i])<<8 | int(section[i+1])
+		if program != 0 {
+			s.pmtPID = int(section[i+2]&0x1f)<<8 | int(section[i+3])
+			return
+		}
+	}
+}
+
+func (s *Segmenter) parsePMT(payload []byte) {
+
+	section := psiSection(payload, 0x02)
+	if len(section) < 12 {
+		return
+	}
+
+	timingPID := -1
+	var streamType byte
+	video := false
+
+	infoLength := int(section[10]&0x0f)<<8 | int(section[11])
+	for i := 12 + infoLength; i+5 <= len(section); {
+		pid := int(section[i+1]&0x1f)<<8 | int(section[i+2])
+		if videoStreamTypes[section[i]] && !video {
+			timingPID, streamType, video = pid, section[i], true
+		} else if timingPID < 0 {
+			timingPID, streamType = pid, section[i]
+		}
+		i += 5 + (int(section[i+3]&0x0f)<<8 | int(section[i+4]))
+	}
+
+	s.timingPID, s.streamType, s.video = timingPID, streamType, video
+}
+
+// psiSection returns the section of a PSI table, without its CRC, when it
+// has the expected table id.
+func psiSection(payload []byte, tableID byte) []byte {
+	if len(payload) < 1 {
+		return nil
+	}
+	pointer := int(payload[0])
+	if 1+pointer+3 > len(payload) {
+		return nil
+	}
+	section := payload[1+pointer:]
+	if section[0] != tableID {
+		return nil
+	}
+	end := 3 + (int(section[1]&0x0f)<<8 | int(section[2])) - 4
+	if end > len(section) || end < 3 {
+		end = len(section)
+	}
+	return section[:end]
+}
+
+func payloadOf(packet []byte) []byte {
+	control := packet[3] >> 4 & 0x03
+	offset := 4
+	if control&0x02 != 0 {
+		offset += 1 + int(packet[4])
+	}
+	if control&0x01 == 0 || offset >= PacketSize {
+		return nil
+	}
+	return packet[offset:]
+}
+
+// randomAccess tells whether the random access indicator of a packet is set.
+func randomAccess(packet []byte) bool {
+	return hasAdaptationField(packet) && packet[5]&0x40 != 0
+}
+
+// parsePTS reads the presentation timestamp of a PES header.
+func parsePTS(payload []byte) (int64, bool) {
+	if len(payload) < 14 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+		return -1, false
+	}
+	if payload[7]&0x80 == 0 {
+		return -1, false
+	}
+	p := payload[9:14]
+	pts := int64(p[0]>>1&0x07)<<30 | int64(p[1])<<22 | int64(p[2]>>1)<<15 | int64(p[3])<<7 | int64(p[4]>>1)
+	return pts, true
+}
+
+// isKeyframe looks for the start of a keyframe in the first packet of a PES
+// packet: a sequence header for MPEG video, a SPS or IDR for H.264 and a
+// VPS or IRAP for H.265.
+func isKeyframe(streamType byte, payload []byte) bool {
+
+	if len(payload) < 9 {
+		return false
+	}
+	offset := 9 + int(payload[8])
+	if offset >= len(payload) {
+		return false
+	}
+	es := payload[offset:]
+
+	for i := 0; i+3 < len(es); i++ {
+		if es[i] != 0 || es[i+1] != 0 || es[i+2] != 1 {
+			continue
+		}
+		nal := es[i+3]
+		switch streamType {
+		case 0x1b:
+			if t := nal & 0x1f; t == 5 || t == 7 {
+				return true
+			}
+		case 0x24:
+			if t := nal >> 1 & 0x3f; (t >= 16 && t <= 21) || t == 32 {
+				return true
+			}
+		case 0x01, 0x02:
+			if nal == 0xb3 {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package mpegts
+
+import (
+	"testing"
+	"time"
+)
+
+func psiPacket(pid uint16, section []byte) []byte {
+	packet := newPacket(pid, false)
+	packet[1] |= 0x40
+	packet[4] = 0 // pointer field
+	copy(packet[5:], section)
+	for i := 5 + len(section); i < PacketSize; i++ {
+		packet[i] = 0xff
+	}
+	return packet
+}
+
+func patPacket() []byte {
+	// program 1 on PID 4096, followed by a dummy CRC
+	return psiPacket(0, []byte{0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xf0, 0x00, 0, 0, 0, 0})
+}
+
+func pmtPacket() []byte {
+	// H.264 on PID 256 and AAC on PID 257, followed by a dummy CRC
+	return psiPacket(4096, []byte{0x02, 0xb0, 0x17, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe1, 0x00, 0xf0, 0x00,
+		0x1b, 0xe1, 0x00, 0xf0, 0x00,
+		0x0f, 0xe1, 0x01, 0xf0, 0x00,
+		0, 0, 0, 0})
+}
+
+func pesPacket(pid uint16, pts int64, keyframe bool) []byte {
+	packet := newPacket(pid, keyframe)
+	packet[1] |= 0x40
+	offset := 4
+	if keyframe {
+		packet[5] = 0x40 // random access indicator
+		offset += 1 + int(packet[4])
+	}
+	header := []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5,
+		byte(0x21 | (pts>>29)&0x0e), byte(pts >> 22), byte(0x01 | (pts>>14)&0xfe), byte(pts >> 7), byte(0x01 | (pts<<1)&0xfe)}
+	copy(packet[offset:], header)
+	return packet
+}
+
+func TestSegmenter(t *testing.T) {
+
+	var segments []Segment
+	segmenter := NewSegmenter(4*time.Second, func(segment Segment) {
+		segments = append(segments, segment)
+	})
+
+	// 25 frames per second, a keyframe every 2 seconds, starting at a non
+	// keyframe which must be dropped
+	var stream []byte
+	stream = append(stream, patPacket()...)
+	stream = append(stream, pmtPacket()...)
+	for frame := int64(10); frame < 510; frame++ {
+		pts := frame * ptsClock / 25
+		if frame >= 300 {
+			// Timestamps jump one hour ahead
+			pts += 3600 * ptsClock
+		}
+		stream = append(stream, pesPacket(256, pts, frame%50 == 0 || frame == 300)...)
+		stream = append(stream, newPacket(257, false)...)
+	}
+
+	// Feed the segmenter with chunks not aligned on packets
+	for len(stream) > 0 {
+		n := min(1000, len(stream))
+		segmenter.Write(stream[:n])
+		stream = stream[n:]
+	}
+	segmenter.Flush()
+
+	expected := []struct {
+		duration      time.Duration
+		discontinuity bool
+	}{
+		{4 * time.Second, false},
+		{4 * time.Second, false},
+		{2*time.Second - 40*time.Millisecond, false},
+		{4 * time.Second, true},
+		{4 * time.Second, false},
+		{360 * time.Millisecond, false},
+	}
+
+	if len(segments) != len(expected) {
+		t.Fatalf("Unexpected number of segments. Expected: %d, Got: %d", len(expected), len(segments))
+	}
+
+	for i, segment := range segments {
+		if segment.Duration != expected[i].duration || segment.Discontinuity != expected[i].discontinuity {
+			t.Errorf("Unexpected segment %d. Expected: %s %v, Got: %s %v", i, expected[i].duration, expected[i].discontinuity, segment.Duration, segment.Discontinuity)
+		}
+		if PID(segment.Data) != 0 || PID(segment.Data[PacketSize:]) != 4096 {
+			t.Errorf("Segment %d should start with the PAT and the PMT", i)
+		}
+		if !randomAccess(segment.Data[2*PacketSize:]) {
+			t.Errorf("Segment %d should start with a keyframe", i)
+		}
+	}
+}
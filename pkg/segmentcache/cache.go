@@ -0,0 +1,368 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package segmentcache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSegmentTTL  = 60
+	DefaultManifestTTL = 1
+
+	diskFileSuffix = ".seg"
+)
+
+type Config struct {
+	// MemorySize and DiskSize are the maximum size, in bytes, of the cached
+	// bodies kept in memory and on disk. The cache is disabled when both are 0.
+	MemorySize  int64  `json:"memory_size,omitempty"`
+	DiskSize    int64  `json:"disk_size,omitempty"`
+	DiskPath    string `json:"disk_path,omitempty"`
+	SegmentTTL  int    `json:"segment_ttl,omitempty"`
+	ManifestTTL int    `json:"manifest_ttl,omitempty"`
+}
+
+// Entry is a cached upstream response.
+type Entry struct {
+	StatusCode int
+	Header     http.Header
+	FinalURL   string
+	Body       []byte
+	Expires    time.Time
+}
+
+type Stats struct {
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Evictions     int64 `json:"evictions"`
+	MemoryEntries int   `json:"memory_entries"`
+	MemoryBytes   int64 `json:"memory_bytes"`
+	DiskEntries   int   `json:"disk_entries"`
+	DiskBytes     int64 `json:"disk_bytes"`
+}
+
+type item struct {
+	key   string
+	entry *Entry
+	size  int64
+	file  string
+}
+
+// lru is a list of items, most recently used first, bounded by the total
+// size of their bodies.
+type lru struct {
+	maxSize int64
+	size    int64
+	order   *list.List
+	items   map[string]*list.Element
+}
+
+func newLRU(maxSize int64) *lru {
+	return &lru{
+		maxSize: maxSize,
+		order:   list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+func (l *lru) get(key string) (*item, bool) {
+	if e, ok := l.items[key]; ok {
+		l.order.MoveToFront(e)
+		return e.Value.(*item), true
+	}
+	return nil, false
+}
+
+func (l *lru) add(it *item) {
+	l.remove(it.key)
+	l.items[it.key] = l.order.PushFront(it)
+	l.size += it.size
+}
+
+func (l *lru) remove(key string) *item {
+	e, ok := l.items[key]
+	if !ok {
+		return nil
+	}
+	it := e.Value.(*item)
+	l.order.Remove(e)
+	delete(l.items, key)
+	l.size -= it.size
+	return it
+}
+
+// evict removes the least recently used items until the list fits its size.
+func (l *lru) evict() []*item {
+	evicted := make([]*item, 0)
+	for l.size > l.maxSize && l.order.Len() > 0 {
+		it := l.order.Back().Value.(*item)
+		l.remove(it.key)
+		evicted = append(evicted, it)
+	}
+	return evicted
+}
+
+// Cache keeps upstream responses in memory and, once evicted from memory, on
+// disk, each tier bounded by its own size.
+type Cache struct {
+	config Config
+	mux    sync.Mutex
+	memory *lru
+	disk   *lru
+	stats  Stats
+}
+
+func New(config Config) *Cache {
+
+	if config.MemorySize <= 0 && config.DiskSize <= 0 {
+		return nil
+	}
+
+	if config.SegmentTTL <= 0 {
+		config.SegmentTTL = DefaultSegmentTTL
+	}
+	if config.ManifestTTL <= 0 {
+		config.ManifestTTL = DefaultManifestTTL
+	}
+
+	c := &Cache{
+		config: config,
+		memory: newLRU(config.MemorySize),
+	}
+
+	if config.DiskSize > 0 && config.DiskPath != "" {
+		if err := os.MkdirAll(config.DiskPath, 0755); err != nil {
+			log.Printf("Failed to create cache directory %s: %s\n", config.DiskPath, err)
+		} else {
+			clearDisk(config.DiskPath)
+			c.disk = newLRU(config.DiskSize)
+		}
+	}
+
+	return c
+}
+
+// clearDisk drops the segments left over by a previous run, the index they
+// belonged to was only kept in memory.
+func clearDisk(path string) {
+	files, _ := filepath.Glob(filepath.Join(path, "*"+diskFileSuffix))
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+func (c *Cache) diskFile(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(c.config.DiskPath, hex.EncodeToString(hash[:])+diskFileSuffix)
+}
+
+// TTL returns how long a response may be cached, honouring the upstream
+// Cache-Control and Expires headers. Manifests are never kept longer than the
+// manifest TTL as live playlists change on every segment.
+func (c *Cache) TTL(header http.Header, manifest bool) time.Duration {
+
+	if c == nil {
+		return 0
+	}
+
+	ttl := time.Duration(c.config.SegmentTTL) * time.Second
+	if manifest {
+		ttl = time.Duration(c.config.ManifestTTL) * time.Second
+	}
+
+	cacheControl := strings.ToLower(header.Get("Cache-Control"))
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		switch {
+		case directive == "no-store", directive == "no-cache", directive == "private":
+			return 0
+		case strings.HasPrefix(directive, "max-age="), strings.HasPrefix(directive, "s-maxage="):
+			seconds, err := strconv.Atoi(directive[strings.Index(directive, "=")+1:])
+			if err != nil {
+				continue
+			}
+			maxAge := time.Duration(seconds) * time.Second
+			if manifest && maxAge > ttl {
+				continue
+			}
+			return maxAge
+		}
+	}
+
+	if expires := header.Get("Expires"); expires != "" && !strings.Contains(cacheControl, "max-age") {
+		if t, err := http.ParseTime(expires); err == nil {
+			maxAge := time.Until(t)
+			if maxAge <= 0 {
+				return 0
+			}
+			if !manifest || maxAge < ttl {
+				return maxAge
+			}
+		} else {
+			return 0
+		}
+	}
+
+	return ttl
+}
+
+func (c *Cache) Get(key string) (*Entry, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if it, ok := c.memory.get(key); ok {
+		if time.Now().Before(it.entry.Expires) {
+			c.stats.Hits++
+			return it.entry, true
+		}
+		c.memory.remove(key)
+	}
+
+	if c.disk != nil {
+		if it, ok := c.disk.get(key); ok {
+			c.disk.remove(key)
+			if time.Now().Before(it.entry.Expires) {
+				body, err := os.ReadFile(it.file)
+				os.Remove(it.file)
+				if err == nil {
+					entry := *it.entry
+					entry.Body = body
+					c.stats.Hits++
+					c.put(key, &entry)
+					return &entry, true
+				}
+			} else {
+				os.Remove(it.file)
+			}
+		}
+	}
+
+	c.stats.Misses++
+	return nil, false
+}
+
+func (c *Cache) Put(key string, entry *Entry) {
+	if c == nil || !time.Now().Before(entry.Expires) {
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.disk != nil {
+		if it := c.disk.remove(key); it != nil {
+			os.Remove(it.file)
+		}
+	}
+	c.put(key, entry)
+}
+
+// put must be called with c.mux held.
+func (c *Cache) put(key string, entry *Entry) {
+
+	size := int64(len(entry.Body))
+	if size > c.config.MemorySize {
+		c.putDisk(&item{key: key, entry: entry, size: size})
+		return
+	}
+
+	c.memory.add(&item{key: key, entry: entry, size: size})
+	for _, it := range c.memory.evict() {
+		c.putDisk(it)
+	}
+}
+
+// putDisk moves an item evicted from memory to disk, when there is a disk
+// tier and it is still worth keeping.
+func (c *Cache) putDisk(it *item) {
+
+	if c.disk == nil || it.size > c.config.DiskSize || !time.Now().Before(it.entry.Expires) {
+		c.stats.Evictions++
+		return
+	}
+
+	file := c.diskFile(it.key)
+	if err := os.WriteFile(file, it.entry.Body, 0644); err != nil {
+		log.Printf("Failed to write cache file %s: %s\n", file, err)
+		c.stats.Evictions++
+		return
+	}
+
+	entry := *it.entry
+	entry.Body = nil
+	c.disk.add(&item{key: it.key, entry: &entry, size: it.size, file: file})
+
+	for _, evicted := range c.disk.evict() {
+		os.Remove(evicted.file)
+		c.stats.Evictions++
+	}
+}
+
+func (c *Cache) Stats() Stats {
+	if c == nil {
+		return Stats{}
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	stats := c.stats
+	stats.MemoryEntries = c.memory.order.Len()
+	stats.MemoryBytes = c.memory.size
+	if c.disk != nil {
+		stats.DiskEntries = c.disk.order.Len()
+		stats.DiskBytes = c.disk.size
+	}
+	return stats
+}
+
+// Close removes the files of the disk tier.
+func (c *Cache) Close() {
+	if c == nil {
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.disk != nil {
+		for c.disk.order.Len() > 0 {
+			it := c.disk.remove(c.disk.order.Back().Value.(*item).key)
+			os.Remove(it.file)
+		}
+	}
+}
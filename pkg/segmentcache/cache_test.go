@@ -0,0 +1,131 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package segmentcache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newEntry(size int) *Entry {
+	return &Entry{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       make([]byte, size),
+		Expires:    time.Now().Add(time.Minute),
+	}
+}
+
+func TestMemoryEviction(t *testing.T) {
+	c := New(Config{MemorySize: 100})
+
+	c.Put("a", newEntry(60))
+	c.Put("b", newEntry(30))
+	c.Get("a")
+	c.Put("c", newEntry(30))
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("Least recently used entry should have been evicted")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("Recently used entry should be cached")
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Evictions != 1 || stats.MemoryBytes != 90 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestDiskTier(t *testing.T) {
+	c := New(Config{MemorySize: 50, DiskSize: 100, DiskPath: t.TempDir()})
+	defer c.Close()
+
+	c.Put("a", newEntry(40))
+	c.Put("b", newEntry(40))
+
+	stats := c.Stats()
+	if stats.MemoryEntries != 1 || stats.DiskEntries != 1 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+
+	entry, ok := c.Get("a")
+	if !ok || len(entry.Body) != 40 {
+		t.Fatal("Entry should be served from disk")
+	}
+}
+
+func TestExpiredEntry(t *testing.T) {
+	c := New(Config{MemorySize: 100})
+
+	entry := newEntry(10)
+	entry.Expires = time.Now().Add(-time.Second)
+	c.Put("a", entry)
+
+	if _, ok := c.Get("a"); ok {
+		t.Error("Expired entry should not be served")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	c := New(Config{MemorySize: 100, SegmentTTL: 30, ManifestTTL: 2})
+
+	tests := []struct {
+		cacheControl string
+		manifest     bool
+		expected     time.Duration
+	}{
+		{"", false, 30 * time.Second},
+		{"", true, 2 * time.Second},
+		{"max-age=300", false, 300 * time.Second},
+		{"max-age=300", true, 2 * time.Second},
+		{"public, max-age=1", true, time.Second},
+		{"no-store", false, 0},
+	}
+
+	for _, test := range tests {
+		header := http.Header{}
+		if test.cacheControl != "" {
+			header.Set("Cache-Control", test.cacheControl)
+		}
+		if ttl := c.TTL(header, test.manifest); ttl != test.expected {
+			t.Errorf("Unexpected TTL for '%s' (manifest: %v). Expected: %s, Got: %s", test.cacheControl, test.manifest, test.expected, ttl)
+		}
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	c := New(Config{})
+	if c != nil {
+		t.Fatal("Cache should be disabled without size limits")
+	}
+
+	c.Put("a", newEntry(10))
+	if _, ok := c.Get("a"); ok {
+		t.Error("Disabled cache should not serve entries")
+	}
+	if ttl := c.TTL(http.Header{"Cache-Control": {"max-age=60"}}, false); ttl != 0 {
+		t.Errorf("Disabled cache should not keep responses, got TTL %s", ttl)
+	}
+}
@@ -24,6 +24,7 @@ package streamserver
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"strings"
@@ -41,6 +42,14 @@ func registerAPIRoutes(r *mux.Router) *mux.Router {
 	r.HandleFunc("/api/v1/playlist", adminAccess(playlistAPIRequest))
 	r.HandleFunc("/api/v1/users", adminAccess(usersAPIRequest))
 	r.HandleFunc("/api/v1/user/{id}", adminAccess(userAPIRequest))
+	r.HandleFunc("/api/v1/providers", adminAccess(providersAPIRequest))
+	r.HandleFunc("/api/v1/providers/{name}/refresh", adminAccess(providerRefreshAPIRequest))
+	r.HandleFunc("/api/v1/epg/matches", adminAccess(epgMatchesAPIRequest))
+	r.HandleFunc("/api/v1/cache", adminAccess(cacheAPIRequest))
+	r.HandleFunc("/api/v1/sessions", adminAccess(sessionsAPIRequest))
+	r.HandleFunc("/api/v1/sessions/{id}", adminAccess(sessionAPIRequest))
+	r.HandleFunc("/api/v1/upstreams", adminAccess(breakersAPIRequest))
+	r.HandleFunc("/api/v1/proxy-pools", adminAccess(proxyPoolsAPIRequest))
 	return r
 }
 
@@ -73,7 +82,7 @@ func configAPIRequest(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		w.Header().Set("Content-Type", "application/json")
-		data, err := json.Marshal(Config)
+		data, err := json.Marshal(currentConfig())
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			return
@@ -207,7 +216,7 @@ func playlistAPIRequest(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		w.Header().Set("Content-Type", "application/json")
-		file, err := os.Open(Config.Playlist)
+		file, err := os.Open(currentConfig().Playlist)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
@@ -253,7 +262,55 @@ func reloadRequest(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPost:
 		w.WriteHeader(http.StatusNoContent)
-		Restart()
+		Reload()
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func providersAPIRequest(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		data, err := json.Marshal(m3uprovider.GetProvidersStatus())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func providerRefreshAPIRequest(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case http.MethodPost:
+		vars := mux.Vars(r)
+		name := vars["name"]
+		if err := RefreshProvider(name); err != nil {
+			log.Printf("Failed to refresh provider %s: %s\n", name, err)
+			if _, ok := m3uprovider.GetProviderStatus(name); !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		status, _ := m3uprovider.GetProviderStatus(name)
+		data, err := json.Marshal(status)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
 		return
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
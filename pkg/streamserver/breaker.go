@@ -0,0 +1,288 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package streamserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerOpenTime = 30
+	defaultRetryBackoff    = 200
+	defaultRetryMaxBackoff = 5000
+)
+
+// The states of a circuit breaker.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// circuitOpenError is returned, without contacting the upstream host, while
+// its breaker is open.
+type circuitOpenError struct {
+	host       string
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open for %s", e.host)
+}
+
+// circuitBreaker tracks the consecutive failures of an upstream host. Once
+// open, the requests fail at once until the open time elapsed, then a
+// single request probes the host: its success closes the breaker, its
+// failure opens it again.
+type circuitBreaker struct {
+	state    string
+	failures int
+	opened   time.Time
+	probing  bool
+	// lastError is the last failure seen, for the admin API.
+	lastError string
+}
+
+// breakerStatus is the view of a breaker given by the admin API.
+type breakerStatus struct {
+	Host      string     `json:"host"`
+	State     string     `json:"state"`
+	Failures  int        `json:"failures"`
+	Opened    *time.Time `json:"opened,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+var (
+	breakers      = make(map[string]*circuitBreaker)
+	breakersMutex sync.Mutex
+)
+
+func breakerFailures() int {
+	if currentConfig().CircuitBreaker.Failures != 0 {
+		return currentConfig().CircuitBreaker.Failures
+	}
+	return defaultBreakerFailures
+}
+
+func breakerOpenTime() time.Duration {
+	if currentConfig().CircuitBreaker.OpenTime > 0 {
+		return time.Duration(currentConfig().CircuitBreaker.OpenTime) * time.Second
+	}
+	return defaultBreakerOpenTime * time.Second
+}
+
+// allowRequest reports whether a request to host may be sent, and whether
+// it is the probe of a half-open breaker.
+func allowRequest(host string) (bool, error) {
+
+	if breakerFailures() < 0 {
+		return false, nil
+	}
+
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+
+	b, ok := breakers[host]
+	if !ok || b.state == breakerClosed {
+		return false, nil
+	}
+
+	remaining := breakerOpenTime() - time.Since(b.opened)
+	if b.state == breakerOpen && remaining <= 0 {
+		b.state = breakerHalfOpen
+		log.Printf("Circuit breaker of %s half-open, probing\n", host)
+	}
+	if b.state == breakerHalfOpen && !b.probing {
+		b.probing = true
+		return true, nil
+	}
+	if remaining <= 0 {
+		// Another request is probing the host
+		remaining = time.Second
+	}
+	return false, &circuitOpenError{host: host, retryAfter: remaining}
+}
+
+// recordResult updates the breaker of host with the outcome of a request,
+// err being nil when the host answered properly.
+func recordResult(host string, probe bool, err error) {
+
+	if breakerFailures() < 0 {
+		return
+	}
+
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+
+	b, ok := breakers[host]
+	if !ok {
+		if err == nil {
+			return
+		}
+		b = &circuitBreaker{state: breakerClosed}
+		breakers[host] = b
+	}
+	if probe {
+		b.probing = false
+	}
+
+	if err == nil {
+		if b.state != breakerClosed {
+			log.Printf("Circuit breaker of %s closed\n", host)
+		}
+		delete(breakers, host)
+		return
+	}
+
+	b.failures++
+	b.lastError = err.Error()
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= breakerFailures()) {
+		if b.state == breakerClosed {
+			log.Printf("Circuit breaker of %s opened after %d failures: %s\n", host, b.failures, err)
+		}
+		b.state = breakerOpen
+		b.opened = time.Now()
+	}
+}
+
+// releaseProbe lets another request probe host, the probe having been
+// abandoned.
+func releaseProbe(host string) {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+
+	if b, ok := breakers[host]; ok {
+		b.probing = false
+	}
+}
+
+// isHostFailure reports whether err shows an unhealthy upstream host, as
+// opposed to a client going away or a missing resource.
+func isHostFailure(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil || errors.Is(err, errUnknownProxyPool) || errors.Is(err, errInvalidProxy) {
+		return false
+	}
+	var statusErr *upstreamError
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode == http.StatusTooManyRequests || statusErr.statusCode >= 500
+	}
+	return true
+}
+
+// retryDelay is the delay before the retry following attempt, a random
+// duration up to the exponential backoff, or the delay asked by the
+// upstream server when shorter than the largest backoff.
+func retryDelay(attempt int, err error) time.Duration {
+
+	backoff := time.Duration(currentConfig().Retry.Backoff) * time.Millisecond
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff * time.Millisecond
+	}
+	maxBackoff := time.Duration(currentConfig().Retry.MaxBackoff) * time.Millisecond
+	if maxBackoff <= 0 {
+		maxBackoff = defaultRetryMaxBackoff * time.Millisecond
+	}
+
+	var statusErr *upstreamError
+	if errors.As(err, &statusErr) {
+		if seconds, err := strconv.Atoi(statusErr.header.Get("Retry-After")); err == nil {
+			if delay := time.Duration(seconds) * time.Second; delay <= maxBackoff {
+				return delay
+			}
+		}
+	}
+
+	delay := backoff << attempt
+	if delay <= 0 || delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(delay))) + 1
+}
+
+// hostOf returns the host a request to URI is sent to.
+func hostOf(URI string) string {
+	u, err := url.Parse(URI)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// breakerKey returns the key of the breaker guarding the requests to URI
+// sent through proxy, a failing proxy must not open the breaker of a host
+// the other routes still reach. Proxy credentials are left out.
+func breakerKey(URI, proxy string) string {
+	host := hostOf(URI)
+	if proxy == "" {
+		return host
+	}
+
+	hops := strings.Split(proxy, ",")
+	for i, hop := range hops {
+		if u, err := url.Parse(strings.TrimSpace(hop)); err == nil && u.Host != "" {
+			hops[i] = u.Host
+		}
+	}
+	return host + " via " + strings.Join(hops, ",")
+}
+
+func breakersAPIRequest(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case http.MethodGet:
+		breakersMutex.Lock()
+		list := make([]breakerStatus, 0, len(breakers))
+		for host, b := range breakers {
+			status := breakerStatus{
+				Host:      host,
+				State:     b.state,
+				Failures:  b.failures,
+				LastError: b.lastError,
+			}
+			if b.state != breakerClosed {
+				opened := b.opened
+				status.Opened = &opened
+			}
+			list = append(list, status)
+		}
+		breakersMutex.Unlock()
+
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Host < list[j].Host
+		})
+		writeJSON(w, list)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package streamserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/a13labs/m3uproxy/pkg/segmentcache"
+)
+
+var (
+	segmentCache      *segmentcache.Cache
+	segmentCacheMutex sync.Mutex
+)
+
+// configureCache replaces the segment cache, dropping its content.
+func configureCache() {
+	segmentCacheMutex.Lock()
+	defer segmentCacheMutex.Unlock()
+
+	segmentCache.Close()
+	segmentCache = segmentcache.New(currentConfig().Cache)
+	if segmentCache != nil {
+		log.Printf("Segment cache enabled, memory: %d bytes, disk: %d bytes\n", currentConfig().Cache.MemorySize, currentConfig().Cache.DiskSize)
+	}
+}
+
+func getSegmentCache() *segmentcache.Cache {
+	segmentCacheMutex.Lock()
+	defer segmentCacheMutex.Unlock()
+	return segmentCache
+}
+
+func responseFromCache(entry *segmentcache.Entry) *sharedResponse {
+	finalURL, _ := url.Parse(entry.FinalURL)
+	return &sharedResponse{
+		statusCode: entry.StatusCode,
+		header:     entry.Header,
+		finalURL:   finalURL,
+		body:       entry.Body,
+	}
+}
+
+func cacheAPIRequest(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case http.MethodGet:
+		data, err := json.Marshal(getSegmentCache().Stats())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package streamserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/a13labs/m3uproxy/pkg/fetch"
+)
+
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 16
+	defaultIdleConnTimeout     = 90
+	defaultKeepAlive           = 30
+	defaultDialTimeout         = 10
+	defaultTLSHandshakeTimeout = 10
+)
+
+// clientKey identifies the settings an upstream client is made for.
+type clientKey struct {
+	proxy    string
+	insecure bool
+	resolver string
+}
+
+var errInvalidProxy = errors.New("invalid proxy")
+
+// invalidProxyTransport fails the requests of the streams whose proxy can't
+// be parsed, rather than connecting them directly.
+type invalidProxyTransport struct {
+	err error
+}
+
+func (t invalidProxyTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, t.err
+}
+
+var (
+	clients       = make(map[clientKey]*http.Client)
+	clientsConfig UpstreamConfig
+	clientsMutex  sync.Mutex
+)
+
+// upstreamClient returns the client, shared by all the streams with the
+// same settings, reaching the upstream servers through proxy, or a comma
+// separated chain of proxies. The clients
+// are rebuilt when the upstream configuration changes.
+func upstreamClient(proxy string) *http.Client {
+
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	config := currentConfig().Upstream
+	if config != clientsConfig {
+		for _, client := range clients {
+			client.CloseIdleConnections()
+		}
+		clients = make(map[clientKey]*http.Client)
+		clientsConfig = config
+	}
+
+	key := clientKey{
+		proxy:    proxy,
+		insecure: config.InsecureSkipVerify,
+		resolver: config.Resolver,
+	}
+	if client, ok := clients[key]; ok {
+		return client
+	}
+
+	client := &http.Client{}
+	if proxies, err := fetch.ParseProxies(proxy); err != nil {
+		log.Printf("Invalid proxy %s, refusing its requests: %s\n", proxy, err)
+		client.Transport = invalidProxyTransport{err: fmt.Errorf("%w %s: %s", errInvalidProxy, proxy, err)}
+	} else {
+		client.Transport = newTransport(key, config, proxies)
+	}
+	clients[key] = client
+	return client
+}
+
+// proxyValid reports whether proxy, or the chain of proxies, can be used.
+func proxyValid(proxy string) bool {
+	_, err := fetch.ParseProxies(proxy)
+	return err == nil
+}
+
+func seconds(value, defaultValue int) time.Duration {
+	if value == 0 {
+		value = defaultValue
+	}
+	return time.Duration(value) * time.Second
+}
+
+func newTransport(key clientKey, config UpstreamConfig, proxies []*url.URL) *http.Transport {
+
+	dialer := &net.Dialer{
+		Timeout:   seconds(config.DialTimeout, defaultDialTimeout),
+		KeepAlive: seconds(config.KeepAlive, defaultKeepAlive),
+	}
+	if key.resolver != "" {
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{Timeout: dialer.Timeout}).DialContext(ctx, network, key.resolver)
+			},
+		}
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		IdleConnTimeout:       seconds(config.IdleConnTimeout, defaultIdleConnTimeout),
+		TLSHandshakeTimeout:   seconds(config.TLSHandshakeTimeout, defaultTLSHandshakeTimeout),
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     !config.DisableHTTP2,
+	}
+	if transport.MaxIdleConns == 0 {
+		transport.MaxIdleConns = defaultMaxIdleConns
+	}
+	if transport.MaxIdleConnsPerHost == 0 {
+		transport.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if config.DisableHTTP2 {
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	if key.insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	fetch.SetProxies(transport, proxies, dialer)
+	return transport
+}
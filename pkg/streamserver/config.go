@@ -24,6 +24,10 @@ package streamserver
 import (
 	"encoding/json"
 	"os"
+	"sync"
+
+	"github.com/a13labs/m3uproxy/pkg/fetch"
+	"github.com/a13labs/m3uproxy/pkg/segmentcache"
 )
 
 type GeoIPConfig struct {
@@ -37,23 +41,252 @@ type SecurityConfig struct {
 	AllowedCORSDomains []string    `json:"allowed_cors_domains,omitempty"`
 }
 
+type EpgMatchConfig struct {
+	Enabled   bool    `json:"enabled,omitempty"`
+	Threshold float64 `json:"threshold,omitempty"`
+}
+
+// TSStreamConfig configures the continuous transport streams made of the
+// segments of HLS streams.
+type TSStreamConfig struct {
+	// Variant selects the variant of a master playlist, "highest" (the
+	// default) or "lowest" bandwidth, bounded by MaxBandwidth when set.
+	Variant      string `json:"variant,omitempty"`
+	MaxBandwidth int    `json:"max_bandwidth,omitempty"`
+	// Adaptive switches variants when segments download slower or much
+	// faster than they play.
+	Adaptive bool `json:"adaptive,omitempty"`
+	// LiveSegments is the number of segments from the end of a live
+	// playlist the stream starts with.
+	LiveSegments int `json:"live_segments,omitempty"`
+}
+
+// ProfilesConfig selects the client profile rendering the playlist of the
+// users, and defines profiles besides the builtin ones.
+type ProfilesConfig struct {
+	Default     string                   `json:"default,omitempty"`
+	Users       map[string]string        `json:"users,omitempty"`
+	Roles       map[string]string        `json:"roles,omitempty"`
+	Definitions map[string]ClientProfile `json:"definitions,omitempty"`
+}
+
+// ChannelPackage selects channels by group, tvg-id or title.
+type ChannelPackage struct {
+	Groups []string `json:"groups,omitempty"`
+	TvgIDs []string `json:"tvg_ids,omitempty"`
+	// Filter is a regular expression matched against the channel titles.
+	Filter string `json:"filter,omitempty"`
+}
+
+// EntitlementsConfig assigns channel packages to users and roles. Users
+// without any get the default packages, "*" grants every channel.
+type EntitlementsConfig struct {
+	Default []string            `json:"default,omitempty"`
+	Users   map[string][]string `json:"users,omitempty"`
+	Roles   map[string][]string `json:"roles,omitempty"`
+}
+
+// Policies applied when a concurrent stream limit is reached.
+const (
+	LimitPolicyRefuse      = "refuse"
+	LimitPolicyEvictOldest = "evict_oldest"
+)
+
+// LimitsConfig limits the streams watched at the same time.
+type LimitsConfig struct {
+	// MaxStreamsPerUser is the number of streams a user may watch at the
+	// same time, 0 for no limit.
+	MaxStreamsPerUser int `json:"max_streams_per_user,omitempty"`
+	// Providers and Hosts limit the streams served from a playlist
+	// provider, or from an upstream host, at the same time.
+	Providers map[string]int `json:"providers,omitempty"`
+	Hosts     map[string]int `json:"hosts,omitempty"`
+	// Policy is either refuse (default) or evict_oldest.
+	Policy string `json:"policy,omitempty"`
+	// SessionTimeout is how long, in seconds, a session is kept without
+	// requests.
+	SessionTimeout int `json:"session_timeout,omitempty"`
+}
+
+// BandwidthLimit is a token bucket: Rate, in kbit/s, is the sustained rate
+// and Burst, in kilobytes, what may be sent at once above it. Burst
+// defaults to one second of Rate.
+type BandwidthLimit struct {
+	Rate  int `json:"rate"`
+	Burst int `json:"burst,omitempty"`
+}
+
+// BandwidthConfig limits the rate the streams are served at. Global is
+// shared by all the viewers, a user limit by all the sessions of the user,
+// role and stream limits apply to each user and each session.
+type BandwidthConfig struct {
+	Global  BandwidthLimit            `json:"global,omitempty"`
+	Users   map[string]BandwidthLimit `json:"users,omitempty"`
+	Roles   map[string]BandwidthLimit `json:"roles,omitempty"`
+	Streams map[string]BandwidthLimit `json:"streams,omitempty"`
+}
+
+// RetryConfig sets how the idempotent upstream requests are retried, with
+// an exponential backoff with jitter.
+type RetryConfig struct {
+	// Attempts is the number of retries after the first attempt.
+	Attempts int `json:"attempts,omitempty"`
+	// Backoff is the delay, in milliseconds, before the first retry, which
+	// doubles with every retry up to MaxBackoff.
+	Backoff    int `json:"backoff,omitempty"`
+	MaxBackoff int `json:"max_backoff,omitempty"`
+}
+
+// CircuitBreakerConfig sets when the requests to an upstream host are
+// short-circuited.
+type CircuitBreakerConfig struct {
+	// Failures is the number of consecutive failures opening the breaker of
+	// a host, a negative value disables the breakers.
+	Failures int `json:"failures,omitempty"`
+	// OpenTime is how long, in seconds, a breaker stays open before letting
+	// a request probe the host.
+	OpenTime int `json:"open_time,omitempty"`
+}
+
+// UpstreamConfig tunes the HTTP clients connecting to the upstream servers.
+// Durations are in seconds.
+type UpstreamConfig struct {
+	MaxIdleConns        int `json:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host,omitempty"`
+	MaxConnsPerHost     int `json:"max_conns_per_host,omitempty"`
+	IdleConnTimeout     int `json:"idle_conn_timeout,omitempty"`
+	// KeepAlive is the interval of the TCP keep-alive probes, a negative
+	// value disables them.
+	KeepAlive int `json:"keep_alive,omitempty"`
+	// DialTimeout bounds the connection to the upstream servers, while
+	// ReadTimeout is the longest they may stall while sending a body.
+	DialTimeout         int  `json:"dial_timeout,omitempty"`
+	ReadTimeout         int  `json:"read_timeout,omitempty"`
+	TLSHandshakeTimeout int  `json:"tls_handshake_timeout,omitempty"`
+	DisableHTTP2        bool `json:"disable_http2,omitempty"`
+	InsecureSkipVerify  bool `json:"insecure_skip_verify,omitempty"`
+	// Resolver is the address of the DNS server resolving the upstream
+	// hosts, the system resolver is used when missing.
+	Resolver string `json:"resolver,omitempty"`
+}
+
+// Selection strategies of the proxy pools.
+const (
+	PoolSelectionRoundRobin = "round_robin"
+	PoolSelectionSticky     = "sticky"
+)
+
+// ProxyPoolConfig is a named group of proxies the channels are spread on.
+type ProxyPoolConfig struct {
+	// Proxies are the members of the pool, each one a proxy URL or a comma
+	// separated chain of proxies.
+	Proxies []string `json:"proxies"`
+	// Selection is either round_robin (default), the channels given the
+	// members in turn, or sticky, the channels spread by a hash of their
+	// id. Either way a channel keeps its member while it is healthy.
+	Selection string `json:"selection,omitempty"`
+	// CheckURL is fetched through each member every CheckInterval seconds,
+	// a member failing Failures checks in a row is left out until it
+	// passes one again.
+	CheckURL      string `json:"check_url,omitempty"`
+	CheckInterval int    `json:"check_interval,omitempty"`
+	CheckTimeout  int    `json:"check_timeout,omitempty"`
+	Failures      int    `json:"failures,omitempty"`
+}
+
+// HDHomeRunConfig configures the emulation of a HDHomeRun tuner.
+type HDHomeRunConfig struct {
+	Enabled      bool   `json:"enabled,omitempty"`
+	FriendlyName string `json:"friendly_name,omitempty"`
+	// DeviceID identifies the device, 8 hexadecimal digits. When missing
+	// a valid id is derived from the host name and the port of the server.
+	DeviceID   string `json:"device_id,omitempty"`
+	TunerCount int    `json:"tuner_count,omitempty"`
+	// AllowedNetworks are the networks, in CIDR notation, the device is
+	// served to. Like a real tuner it requires no credentials, so it is
+	// served to nobody when missing.
+	AllowedNetworks []string `json:"allowed_networks,omitempty"`
+	// Packages are the channel packages the device serves, the default
+	// entitlement when missing.
+	Packages []string `json:"packages,omitempty"`
+}
+
+// HLSPackagingConfig configures the HLS packaging of continuous transport
+// streams.
+type HLSPackagingConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// SegmentDuration is the target duration of the segments, in seconds.
+	SegmentDuration int `json:"segment_duration,omitempty"`
+	// PlaylistSegments is the number of segments listed in the playlist.
+	PlaylistSegments int `json:"playlist_segments,omitempty"`
+}
+
 type ServerConfig struct {
-	Port       int             `json:"port"`
-	Playlist   string          `json:"playlist"`
-	Epg        string          `json:"epg"`
-	Timeout    int             `json:"default_timeout,omitempty"`
-	NumWorkers int             `json:"num_workers,omitempty"`
-	ScanTime   int             `json:"scan_time,omitempty"`
-	Security   SecurityConfig  `json:"security,omitempty"`
-	Auth       json.RawMessage `json:"auth"`
-	LogFile    string          `json:"log_file,omitempty"`
+	Port       int                 `json:"port"`
+	Playlist   string              `json:"playlist"`
+	Epg        string              `json:"epg"`
+	EpgOptions fetch.Config        `json:"epg_options,omitempty"`
+	EpgMatch   EpgMatchConfig      `json:"epg_match,omitempty"`
+	TSStream   TSStreamConfig      `json:"ts_stream,omitempty"`
+	Packaging  HLSPackagingConfig  `json:"hls_packaging,omitempty"`
+	HDHomeRun  HDHomeRunConfig     `json:"hdhomerun,omitempty"`
+	Profiles   ProfilesConfig      `json:"profiles,omitempty"`
+	Cache      segmentcache.Config `json:"cache,omitempty"`
+	Timeout    int                 `json:"default_timeout,omitempty"`
+	NumWorkers int                 `json:"num_workers,omitempty"`
+	ScanTime   int                 `json:"scan_time,omitempty"`
+	Security   SecurityConfig      `json:"security,omitempty"`
+	Auth       json.RawMessage     `json:"auth"`
+	LogFile    string              `json:"log_file,omitempty"`
+	// WatchTime is the interval, in seconds, between checks for changes
+	// on the configuration files. A negative value disables the watcher.
+	WatchTime int `json:"watch_time,omitempty"`
+	// DisableIndexRedirect stops redirecting index based stream URLs, used
+	// before stable stream ids, to the stream id.
+	DisableIndexRedirect bool `json:"disable_index_redirect,omitempty"`
+	// RemapSecret seals the upstream URIs of remapped playlists, RemapTTL is
+	// how long, in seconds, a remapped URI stays valid.
+	RemapSecret string `json:"remap_secret,omitempty"`
+	RemapTTL    int    `json:"remap_ttl,omitempty"`
+	// PassthroughHeaders lists the upstream response headers forwarded to
+	// the clients, a default set is used when missing.
+	PassthroughHeaders []string `json:"passthrough_headers,omitempty"`
+	// BlockingReloadTimeout is how long, in seconds, a Low-Latency HLS
+	// blocking playlist reload may wait for the upstream server.
+	BlockingReloadTimeout int `json:"blocking_reload_timeout,omitempty"`
+	// Packages are the channel packages, by name, granted by Entitlements.
+	Packages     map[string]ChannelPackage `json:"packages,omitempty"`
+	Entitlements EntitlementsConfig        `json:"entitlements,omitempty"`
+	Limits       LimitsConfig              `json:"limits,omitempty"`
+	Bandwidth    BandwidthConfig           `json:"bandwidth,omitempty"`
+	// Retry and CircuitBreaker handle the failures of the upstream servers.
+	Retry          RetryConfig          `json:"upstream_retry,omitempty"`
+	CircuitBreaker CircuitBreakerConfig `json:"circuit_breaker,omitempty"`
+	Upstream       UpstreamConfig       `json:"upstream,omitempty"`
+	// ProxyPools are the proxy pools, by name, the channels may use.
+	ProxyPools map[string]ProxyPoolConfig `json:"proxy_pools,omitempty"`
 }
 
 var (
-	Config     *ServerConfig
-	ConfigPath string
+	Config      *ServerConfig
+	ConfigPath  string
+	configMutex sync.RWMutex
 )
 
+// currentConfig returns the running configuration, the watcher may swap it
+// at any time so it must be used instead of reading Config directly.
+func currentConfig() *ServerConfig {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return Config
+}
+
+func setConfig(config *ServerConfig) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	Config = config
+}
+
 func (c *ServerConfig) Merge(other ServerConfig) {
 	if other.Timeout != 0 {
 		c.Timeout = other.Timeout
@@ -64,6 +297,9 @@ func (c *ServerConfig) Merge(other ServerConfig) {
 	if other.ScanTime != 0 {
 		c.ScanTime = other.ScanTime
 	}
+	if other.WatchTime != 0 {
+		c.WatchTime = other.WatchTime
+	}
 	if len(other.Security.GeoIP.Whitelist) > 0 {
 		c.Security.GeoIP.Whitelist = other.Security.GeoIP.Whitelist
 	}
@@ -72,26 +308,38 @@ func (c *ServerConfig) Merge(other ServerConfig) {
 	}
 }
 
-func LoadServerConfig(path string) error {
+func readServerConfig(path string) (*ServerConfig, error) {
 
 	_, err := os.Stat(path)
 
 	if os.IsNotExist(err) {
-		return err
+		return nil, err
 	}
 
 	file, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer file.Close()
 
-	err = json.NewDecoder(file).Decode(&Config)
+	config := ServerConfig{}
+	err = json.NewDecoder(file).Decode(&config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+func LoadServerConfig(path string) error {
+
+	config, err := readServerConfig(path)
 	if err != nil {
 		return err
 	}
 
+	setConfig(config)
 	ConfigPath = path
 
 	return nil
@@ -99,7 +347,10 @@ func LoadServerConfig(path string) error {
 
 func SaveServerConfig(config ServerConfig) error {
 
-	Config.Merge(config)
+	// The running configuration is left untouched, the file is applied by
+	// the next reload like any other change
+	updated := *currentConfig()
+	updated.Merge(config)
 
 	file, err := os.Create(ConfigPath)
 	if err != nil {
@@ -109,5 +360,5 @@ func SaveServerConfig(config ServerConfig) error {
 
 	encoder := json.NewEncoder(file)
 	encoder.SetIndent("", "  ")
-	return encoder.Encode(Config)
+	return encoder.Encode(&updated)
 }
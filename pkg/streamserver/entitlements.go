@@ -0,0 +1,155 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package streamserver
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+
+	"github.com/a13labs/m3uproxy/pkg/auth"
+)
+
+// allChannels grants every channel when assigned instead of a package.
+const allChannels = "*"
+
+type channelPackage struct {
+	groups map[string]bool
+	tvgIDs map[string]bool
+	filter *regexp.Regexp
+}
+
+var (
+	channelPackages   map[string]*channelPackage
+	entitlementsMutex sync.RWMutex
+)
+
+// configureEntitlements compiles the channel packages, keeping the running
+// ones when the configuration is invalid.
+func configureEntitlements() error {
+
+	packages := make(map[string]*channelPackage, len(currentConfig().Packages))
+	for name, config := range currentConfig().Packages {
+		p := &channelPackage{
+			groups: make(map[string]bool),
+			tvgIDs: make(map[string]bool),
+		}
+		for _, group := range config.Groups {
+			p.groups[group] = true
+		}
+		for _, id := range config.TvgIDs {
+			p.tvgIDs[id] = true
+		}
+		if config.Filter != "" {
+			filter, err := regexp.Compile(config.Filter)
+			if err != nil {
+				return fmt.Errorf("invalid filter of package %s: %w", name, err)
+			}
+			p.filter = filter
+		}
+		packages[name] = p
+	}
+
+	assignments := [][]string{currentConfig().Entitlements.Default}
+	for _, names := range currentConfig().Entitlements.Users {
+		assignments = append(assignments, names)
+	}
+	for _, names := range currentConfig().Entitlements.Roles {
+		assignments = append(assignments, names)
+	}
+	for _, names := range assignments {
+		for _, name := range names {
+			if _, ok := packages[name]; !ok && name != allChannels {
+				log.Printf("Unknown channel package %s, ignored\n", name)
+			}
+		}
+	}
+
+	entitlementsMutex.Lock()
+	defer entitlementsMutex.Unlock()
+	channelPackages = packages
+	return nil
+}
+
+func (p *channelPackage) contains(stream *streamStruct) bool {
+	return p.groups[stream.m3u.TVGTags.GetValue("group-title")] ||
+		p.tvgIDs[stream.m3u.TVGTags.GetValue("tvg-id")] ||
+		(p.filter != nil && p.filter.MatchString(stream.m3u.Title))
+}
+
+// entitlement is the set of channel packages granted to a user, nil when
+// the user may watch every channel.
+type entitlement []*channelPackage
+
+// getEntitlement returns the channel packages granted to the owner of a
+// token. Every channel is granted when no entitlements are configured.
+func getEntitlement(token string) entitlement {
+
+	config := currentConfig().Entitlements
+	if len(config.Default) == 0 && len(config.Users) == 0 && len(config.Roles) == 0 {
+		return nil
+	}
+
+	var names []string
+	if user, err := auth.GetUserFromToken(token); err == nil {
+		names = append(names, config.Users[user]...)
+	}
+	if role, err := auth.GetRoleFromToken(token); err == nil {
+		names = append(names, config.Roles[role]...)
+	}
+	if len(names) == 0 {
+		names = config.Default
+	}
+	return packagesEntitlement(names)
+}
+
+// packagesEntitlement returns the entitlement granting the given channel
+// packages.
+func packagesEntitlement(names []string) entitlement {
+
+	entitlementsMutex.RLock()
+	defer entitlementsMutex.RUnlock()
+
+	granted := make(entitlement, 0, len(names))
+	for _, name := range names {
+		if name == allChannels {
+			return nil
+		}
+		if p, ok := channelPackages[name]; ok {
+			granted = append(granted, p)
+		}
+	}
+	return granted
+}
+
+func (e entitlement) allows(stream *streamStruct) bool {
+	if e == nil {
+		return true
+	}
+	for _, p := range e {
+		if p.contains(stream) {
+			return true
+		}
+	}
+	return false
+}
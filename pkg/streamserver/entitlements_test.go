@@ -0,0 +1,105 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package streamserver
+
+import (
+	"testing"
+
+	"github.com/a13labs/m3uproxy/pkg/m3uparser"
+)
+
+func newTestStream(title, group, tvgID string) *streamStruct {
+	return &streamStruct{
+		id: tvgID,
+		m3u: m3uparser.M3UEntry{
+			Title: title,
+			TVGTags: m3uparser.M3UTvgTags{
+				{Tag: "tvg-id", Value: tvgID},
+				{Tag: "group-title", Value: group},
+			},
+		},
+	}
+}
+
+func TestEntitlements(t *testing.T) {
+	Config = &ServerConfig{
+		Packages: map[string]ChannelPackage{
+			"news":   {Groups: []string{"News"}},
+			"sports": {TvgIDs: []string{"sport1.tv"}, Filter: "^Sport"},
+		},
+		Entitlements: EntitlementsConfig{Default: []string{"news"}},
+	}
+	if err := configureEntitlements(); err != nil {
+		t.Fatalf("Failed to configure entitlements: %v", err)
+	}
+
+	news := newTestStream("World News", "News", "news.tv")
+	sport1 := newTestStream("Sport 1", "Sports", "sport1.tv")
+	sport2 := newTestStream("Sport 2", "Sports", "sport2.tv")
+	movies := newTestStream("Movies", "Movies", "movies.tv")
+
+	tests := []struct {
+		name     string
+		packages []string
+		stream   *streamStruct
+		expected bool
+	}{
+		{"matched by group", []string{"news"}, news, true},
+		{"matched by tvg-id", []string{"sports"}, sport1, true},
+		{"matched by title filter", []string{"sports"}, sport2, true},
+		{"outside the packages", []string{"news", "sports"}, movies, false},
+		{"every channel", []string{allChannels}, movies, true},
+		{"unknown package", []string{"missing"}, news, false},
+		{"no package", []string{}, news, false},
+	}
+
+	for _, test := range tests {
+		if allowed := packagesEntitlement(test.packages).allows(test.stream); allowed != test.expected {
+			t.Errorf("%s: unexpected result for %s. Expected: %v, Got: %v", test.name, test.stream.m3u.Title, test.expected, allowed)
+		}
+	}
+
+	if granted := getEntitlement(""); !granted.allows(news) || granted.allows(movies) {
+		t.Error("Tokens without a user should get the default packages")
+	}
+
+	Config.Entitlements = EntitlementsConfig{}
+	if granted := getEntitlement(""); granted != nil || !granted.allows(movies) {
+		t.Error("Every channel should be granted without entitlements")
+	}
+}
+
+func TestEntitlementsInvalidFilter(t *testing.T) {
+	Config = &ServerConfig{Packages: map[string]ChannelPackage{"news": {Groups: []string{"News"}}}}
+	if err := configureEntitlements(); err != nil {
+		t.Fatalf("Failed to configure entitlements: %v", err)
+	}
+
+	Config = &ServerConfig{Packages: map[string]ChannelPackage{"broken": {Filter: "("}}}
+	if err := configureEntitlements(); err == nil {
+		t.Error("Expected error for invalid filter")
+	}
+	if len(packagesEntitlement([]string{"news"})) != 1 {
+		t.Error("Invalid packages should not replace the running ones")
+	}
+}
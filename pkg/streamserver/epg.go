@@ -25,6 +25,7 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/a13labs/m3uproxy/pkg/fetch"
 	"github.com/gorilla/mux"
 )
 
@@ -35,16 +36,16 @@ func epgRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	content, err := loadContent(Config.Epg)
+	content, err := fetch.ReadAll(currentConfig().Epg, currentConfig().EpgOptions)
 	if err != nil {
 		http.Error(w, "EPG file not found", http.StatusNotFound)
-		log.Printf("EPG file not found at %s\n", Config.Epg)
+		log.Printf("EPG file not found at %s\n", currentConfig().Epg)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/xml")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(content))
+	w.Write(content)
 }
 
 func registerEpgRoutes(r *mux.Router) *mux.Router {
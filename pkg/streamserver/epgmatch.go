@@ -0,0 +1,158 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package streamserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/a13labs/m3uproxy/pkg/fetch"
+	"github.com/a13labs/m3uproxy/pkg/m3uparser"
+	"github.com/a13labs/m3uproxy/pkg/m3uprovider"
+	"github.com/a13labs/m3uproxy/pkg/xmltv"
+)
+
+// epgMatch is a matcher result along with the override key to use when
+// approving it.
+type epgMatch struct {
+	Key string `json:"key"`
+	xmltv.Match
+}
+
+var (
+	epgMatchReport      = make([]epgMatch, 0)
+	epgMatchReportMutex sync.Mutex
+)
+
+func loadEpgChannels() ([]xmltv.Channel, error) {
+	reader, err := fetch.Open(currentConfig().Epg, currentConfig().EpgOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return xmltv.DecodeChannels(reader)
+}
+
+// matchEpgChannels assigns tvg-ids to the entries with a missing or unknown
+// tvg-id, when a single EPG channel matches their title with enough
+// confidence, and keeps a report of every entry considered.
+func matchEpgChannels(playlist *m3uparser.M3UPlaylist) {
+
+	if !currentConfig().EpgMatch.Enabled || currentConfig().Epg == "" {
+		return
+	}
+
+	channels, err := loadEpgChannels()
+	if err != nil {
+		log.Printf("Failed to load EPG channels: %s\n", err)
+		return
+	}
+
+	matcher := xmltv.NewMatcher(channels, currentConfig().EpgMatch.Threshold)
+	report := make([]epgMatch, 0)
+	assigned := 0
+
+	for i := range playlist.Entries {
+		entry := &playlist.Entries[i]
+		tvgId := entry.TVGTags.GetValue("tvg-id")
+		if tvgId != "" && matcher.HasChannel(tvgId) {
+			continue
+		}
+
+		key := tvgId
+		if key == "" {
+			key = entry.Title
+		}
+
+		match := matcher.Match(entry.Title, tvgId)
+		if match.Status == xmltv.MatchAssigned && playlist.SearchEntryByTvgTag("tvg-id", match.AssignedID) == nil {
+			entry.SetTvgTag("tvg-id", match.AssignedID)
+			assigned++
+		}
+		report = append(report, epgMatch{Key: key, Match: match})
+	}
+
+	log.Printf("EPG matching: %d entries checked, %d tvg-ids assigned\n", len(report), assigned)
+
+	epgMatchReportMutex.Lock()
+	epgMatchReport = report
+	epgMatchReportMutex.Unlock()
+}
+
+// approveEpgMatches stores the approved tvg-ids as playlist overrides, keyed
+// by the entry tvg-id, or title when it has none.
+func approveEpgMatches(approved map[string]string) error {
+
+	config, err := m3uprovider.LoadPlaylistConfig(currentConfig().Playlist)
+	if err != nil {
+		return err
+	}
+
+	if config.Overrides == nil {
+		config.Overrides = make(map[string]m3uprovider.OverrideEntry)
+	}
+
+	for key, tvgId := range approved {
+		override := config.Overrides[key]
+		override.TvgID = tvgId
+		config.Overrides[key] = override
+	}
+
+	return config.SaveToFile(currentConfig().Playlist)
+}
+
+func epgMatchesAPIRequest(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case http.MethodGet:
+		epgMatchReportMutex.Lock()
+		data, err := json.Marshal(epgMatchReport)
+		epgMatchReportMutex.Unlock()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+		return
+	case http.MethodPost:
+		approved := make(map[string]string)
+		err := json.NewDecoder(r.Body).Decode(&approved)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		err = approveEpgMatches(approved)
+		if err != nil {
+			log.Printf("Failed to approve EPG matches: %s\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
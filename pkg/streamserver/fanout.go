@@ -0,0 +1,361 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package streamserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/a13labs/m3uproxy/pkg/segmentcache"
+)
+
+const (
+	// maxSharedBodySize bounds the manifests and segments buffered to be
+	// shared between viewers.
+	maxSharedBodySize = 64 << 20
+
+	broadcastChunkSize  = 32 << 10
+	subscriberQueueSize = 256
+	broadcastIdleTime   = 10 * time.Second
+)
+
+var errBodyTooLarge = errors.New("upstream response too large to share")
+
+// sharedResponse is an upstream response shared by every viewer requesting
+// the same URL. Finite responses, manifests and segments, are buffered in
+// body; continuous ones are fanned out by broadcast.
+type sharedResponse struct {
+	statusCode int
+	header     http.Header
+	finalURL   *url.URL
+	body       []byte
+	broadcast  *broadcaster
+}
+
+// sharedFetch is an upstream request in flight, waited on by refs viewers.
+type sharedFetch struct {
+	done   chan struct{}
+	resp   *sharedResponse
+	err    error
+	refs   int
+	cancel context.CancelFunc
+}
+
+var (
+	sharedFetches = make(map[string]*sharedFetch)
+	broadcasters  = make(map[string]*broadcaster)
+	fanoutMutex   sync.Mutex
+)
+
+// sharedKey identifies the upstream responses viewers may share: those of
+// the same URL fetched through the same proxy.
+func sharedKey(uri, proxy string) string {
+	if proxy == "" {
+		return uri
+	}
+	return proxy + "\x00" + uri
+}
+
+// fetchShared coalesces concurrent requests for the same upstream URL, made
+// through the same proxy, into a single upstream fetch. When continuous is
+// set, a response that is neither a playlist nor of known length is fanned
+// out to every viewer instead of buffered.
+func fetchShared(ctx context.Context, uri string, client *http.Client, proxy string, headers map[string]string, continuous bool) (*sharedResponse, error) {
+
+	key := sharedKey(uri, proxy)
+	if entry, ok := getSegmentCache().Get(key); ok {
+		return responseFromCache(entry), nil
+	}
+
+	fanoutMutex.Lock()
+	if b, ok := broadcasters[key]; ok {
+		fanoutMutex.Unlock()
+		return b.response, nil
+	}
+
+	f, ok := sharedFetches[key]
+	if !ok {
+		fetchCtx, cancel := context.WithCancel(context.Background())
+		f = &sharedFetch{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		sharedFetches[key] = f
+		go f.run(fetchCtx, key, uri, client, proxy, headers, continuous)
+	}
+	f.refs++
+	fanoutMutex.Unlock()
+
+	select {
+	case <-f.done:
+		f.release(false)
+		return f.resp, f.err
+	case <-ctx.Done():
+		f.release(true)
+		return nil, ctx.Err()
+	}
+}
+
+// release drops a viewer from the fetch, cancelling the upstream request when
+// the last viewer gave up before it completed.
+func (f *sharedFetch) release(abandoned bool) {
+	fanoutMutex.Lock()
+	defer fanoutMutex.Unlock()
+	f.refs--
+	if abandoned && f.refs == 0 {
+		f.cancel()
+	}
+}
+
+func (f *sharedFetch) run(ctx context.Context, key, uri string, client *http.Client, proxy string, headers map[string]string, continuous bool) {
+
+	var b *broadcaster
+	defer func() {
+		fanoutMutex.Lock()
+		delete(sharedFetches, key)
+		if b != nil {
+			broadcasters[key] = b
+		}
+		close(f.done)
+		fanoutMutex.Unlock()
+	}()
+
+	resp, err := executeRequestContext(ctx, "GET", uri, client, proxy, headers)
+	if err != nil {
+		f.cancel()
+		f.err = err
+		return
+	}
+
+	shared := &sharedResponse{
+		statusCode: resp.StatusCode,
+		header:     resp.Header.Clone(),
+		finalURL:   resp.Request.URL,
+	}
+
+	if continuous && resp.ContentLength < 0 && !isPlaylistContentType(resp.Header.Get("Content-Type")) {
+		b = newBroadcaster(key, uri, shared, resp.Body, f.cancel)
+		shared.broadcast = b
+		f.resp = shared
+		return
+	}
+
+	defer f.cancel()
+	defer resp.Body.Close()
+
+	if resp.ContentLength > maxSharedBodySize {
+		f.err = errBodyTooLarge
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSharedBodySize+1))
+	if err != nil {
+		f.err = err
+		return
+	}
+	if len(body) > maxSharedBodySize {
+		f.err = errBodyTooLarge
+		return
+	}
+
+	shared.body = body
+	f.resp = shared
+
+	cache := getSegmentCache()
+	if ttl := cache.TTL(shared.header, isPlaylistContentType(shared.header.Get("Content-Type"))); ttl > 0 {
+		cache.Put(key, &segmentcache.Entry{
+			StatusCode: shared.statusCode,
+			Header:     shared.header,
+			FinalURL:   shared.finalURL.String(),
+			Body:       shared.body,
+			Expires:    time.Now().Add(ttl),
+		})
+	}
+}
+
+// broadcaster reads a continuous upstream once and copies it to every
+// subscribed viewer. Upstream reading stops when the last viewer leaves.
+type broadcaster struct {
+	key         string
+	uri         string
+	response    *sharedResponse
+	body        io.ReadCloser
+	cancel      context.CancelFunc
+	mux         sync.Mutex
+	subscribers map[chan []byte]struct{}
+	started     bool
+	closed      bool
+	idleTimer   *time.Timer
+}
+
+func newBroadcaster(key, uri string, response *sharedResponse, body io.ReadCloser, cancel context.CancelFunc) *broadcaster {
+	b := &broadcaster{
+		key:         key,
+		uri:         uri,
+		response:    response,
+		body:        body,
+		cancel:      cancel,
+		subscribers: make(map[chan []byte]struct{}),
+	}
+	// Nobody may come to collect the stream if every viewer gave up
+	b.idleTimer = time.AfterFunc(broadcastIdleTime, func() {
+		b.mux.Lock()
+		defer b.mux.Unlock()
+		if len(b.subscribers) == 0 {
+			b.stop()
+		}
+	})
+	return b
+}
+
+func (b *broadcaster) subscribe() (chan []byte, bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.closed {
+		return nil, false
+	}
+
+	ch := make(chan []byte, subscriberQueueSize)
+	b.subscribers[ch] = struct{}{}
+	b.idleTimer.Stop()
+
+	if !b.started {
+		b.started = true
+		go b.run()
+	}
+	return ch, true
+}
+
+func (b *broadcaster) unsubscribe(ch chan []byte) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if _, ok := b.subscribers[ch]; !ok {
+		return
+	}
+	delete(b.subscribers, ch)
+	close(ch)
+
+	if len(b.subscribers) == 0 {
+		log.Printf("Last viewer left %s, closing upstream\n", b.uri)
+		b.stop()
+	}
+}
+
+// stop must be called with b.mux held.
+func (b *broadcaster) stop() {
+	if b.closed {
+		return
+	}
+	b.closed = true
+
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+
+	b.cancel()
+	b.body.Close()
+
+	fanoutMutex.Lock()
+	if broadcasters[b.key] == b {
+		delete(broadcasters, b.key)
+	}
+	fanoutMutex.Unlock()
+}
+
+func (b *broadcaster) run() {
+	for {
+		chunk := make([]byte, broadcastChunkSize)
+		n, err := b.body.Read(chunk)
+
+		b.mux.Lock()
+		if n > 0 {
+			for ch := range b.subscribers {
+				select {
+				case ch <- chunk[:n]:
+				default:
+					// A viewer that can't keep up must not stall the others
+					log.Printf("Viewer too slow for %s, dropping\n", b.uri)
+					delete(b.subscribers, ch)
+					close(ch)
+				}
+			}
+			if len(b.subscribers) == 0 {
+				log.Printf("Last viewer dropped from %s, closing upstream\n", b.uri)
+				b.stop()
+			}
+		}
+		if err != nil || b.closed {
+			b.stop()
+			b.mux.Unlock()
+			return
+		}
+		b.mux.Unlock()
+	}
+}
+
+// serveBroadcast copies a continuous upstream to the viewer until either side
+// goes away. HEAD requests are answered without subscribing, the stream
+// never ends.
+func serveBroadcast(w http.ResponseWriter, r *http.Request, b *broadcaster) {
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	ch, ok := b.subscribe()
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	for {
+		select {
+		case chunk, ok := <-ch:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(chunk); err != nil {
+				b.unsubscribe(ch)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			b.unsubscribe(ch)
+			return
+		}
+	}
+}
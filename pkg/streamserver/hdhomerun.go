@@ -0,0 +1,398 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package streamserver
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultTunerCount    = 2
+	defaultFriendlyName  = "m3uproxy"
+	hdhomerunModel       = "HDTC-2US"
+	hdhomerunFirmware    = "hdhomeruntc_atsc"
+	hdhomerunFirmwareVer = "20200101"
+	// hdhomerunTunersInUse is the error reported by the devices when all
+	// their tuners are used.
+	hdhomerunTunersInUse = "805 All Tuners In Use"
+)
+
+// deviceIDChecksum is the table used to validate HDHomeRun device ids.
+var deviceIDChecksum = [16]uint32{0xa, 0x5, 0xf, 0x6, 0x7, 0xc, 0x1, 0xb, 0x9, 0x2, 0x8, 0xd, 0x4, 0x3, 0xe, 0x0}
+
+var (
+	tunersInUse int
+	tunersMutex sync.Mutex
+
+	hdhomerunNetworks      []*net.IPNet
+	hdhomerunNetworksMutex sync.RWMutex
+)
+
+const hdhomerunXML = `<?xml version="1.0" encoding="UTF-8"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+	<specVersion><major>1</major><minor>0</minor></specVersion>
+	<URLBase>%s</URLBase>
+	<device>
+		<deviceType>urn:schemas-upnp-org:device:MediaServer:1</deviceType>
+		<friendlyName>%s</friendlyName>
+		<manufacturer>Silicondust</manufacturer>
+		<modelName>%s</modelName>
+		<modelNumber>%s</modelNumber>
+		<serialNumber>%s</serialNumber>
+		<UDN>uuid:%s</UDN>
+	</device>
+</root>
+`
+
+type hdhomerunDiscover struct {
+	FriendlyName    string
+	Manufacturer    string
+	ModelNumber     string
+	FirmwareName    string
+	FirmwareVersion string
+	DeviceID        string
+	DeviceAuth      string
+	TunerCount      int
+	BaseURL         string
+	LineupURL       string
+}
+
+type hdhomerunChannel struct {
+	GuideNumber string
+	GuideName   string
+	URL         string
+	stream      *streamStruct
+}
+
+// deviceIDValid applies the HDHomeRun device id checksum.
+func deviceIDValid(id uint32) bool {
+	var checksum uint32
+	for shift := 28; shift >= 0; shift -= 8 {
+		checksum ^= deviceIDChecksum[(id>>shift)&0x0f]
+		checksum ^= (id >> (shift - 4)) & 0x0f
+	}
+	return checksum == 0
+}
+
+// hdhomerunDeviceID returns the configured device id, or one derived from
+// the host name and the port, so each instance gets its own.
+func hdhomerunDeviceID() string {
+
+	if currentConfig().HDHomeRun.DeviceID != "" {
+		return strings.ToUpper(currentConfig().HDHomeRun.DeviceID)
+	}
+
+	hostname, _ := os.Hostname()
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d", hostname, currentConfig().Port)))
+	id := binary.BigEndian.Uint32(sum[:4]) &^ 0x0f
+
+	// The last digit makes the checksum valid
+	for digit := uint32(0); digit < 16; digit++ {
+		if deviceIDValid(id | digit) {
+			id |= digit
+			break
+		}
+	}
+	return fmt.Sprintf("%08X", id)
+}
+
+// configureHDHomeRun parses the networks the device is served to, keeping
+// the running ones when the configuration is invalid.
+func configureHDHomeRun() error {
+
+	networks := make([]*net.IPNet, 0, len(currentConfig().HDHomeRun.AllowedNetworks))
+	for _, cidr := range currentConfig().HDHomeRun.AllowedNetworks {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid HDHomeRun allowed network %s: %w", cidr, err)
+		}
+		networks = append(networks, ipnet)
+	}
+
+	if currentConfig().HDHomeRun.Enabled && len(networks) == 0 {
+		log.Println("HDHomeRun emulation has no allowed networks, it will refuse every client")
+	}
+
+	hdhomerunNetworksMutex.Lock()
+	defer hdhomerunNetworksMutex.Unlock()
+	hdhomerunNetworks = networks
+	return nil
+}
+
+// hdhomerunAllowed checks both the address of the connection and the one
+// forwarded by a reverse proxy, so forged headers can not get around the
+// allowed networks.
+func hdhomerunAllowed(r *http.Request) bool {
+
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+
+	hdhomerunNetworksMutex.RLock()
+	defer hdhomerunNetworksMutex.RUnlock()
+
+	for _, address := range []string{peer, clientIP(r)} {
+		ip := net.ParseIP(address)
+		allowed := false
+		for _, network := range hdhomerunNetworks {
+			if ip != nil && network.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// hdhomerunEntitlement returns the channels served by the device, those of
+// its own packages or else of the default entitlement.
+func hdhomerunEntitlement() entitlement {
+	if packages := currentConfig().HDHomeRun.Packages; len(packages) > 0 {
+		return packagesEntitlement(packages)
+	}
+	return getEntitlement("")
+}
+
+func hdhomerunTunerCount() int {
+	if currentConfig().HDHomeRun.TunerCount > 0 {
+		return currentConfig().HDHomeRun.TunerCount
+	}
+	return defaultTunerCount
+}
+
+func baseURL(r *http.Request) string {
+	scheme := r.Header.Get("X-Forwarded-Proto")
+	if scheme == "" {
+		scheme = r.URL.Scheme
+	}
+	if scheme == "" {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
+
+// hdhomerunLineup lists the active streams served by the device by guide
+// number, taken from their tvg-chno. Streams without one, or sharing it, are
+// numbered after the highest one by their position in the playlist, so the
+// numbers do not move when other streams go up or down.
+func hdhomerunLineup(base string) []hdhomerunChannel {
+
+	granted := hdhomerunEntitlement()
+
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+
+	used := make(map[string]bool)
+	first := 1
+	for _, stream := range streams {
+		if n, err := strconv.Atoi(stream.m3u.TVGTags.GetValue("tvg-chno")); err == nil && n >= first {
+			first = n + 1
+		}
+	}
+
+	lineup := make([]hdhomerunChannel, 0, len(streams))
+	for _, stream := range streams {
+		number := strings.TrimSpace(stream.m3u.TVGTags.GetValue("tvg-chno"))
+		if number == "" || used[number] {
+			number = strconv.Itoa(first + stream.index)
+		}
+		used[number] = true
+
+		if !stream.active || !granted.allows(stream) {
+			continue
+		}
+
+		lineup = append(lineup, hdhomerunChannel{
+			GuideNumber: number,
+			GuideName:   stream.m3u.Title,
+			URL:         fmt.Sprintf("%s/auto/v%s", base, number),
+			stream:      stream,
+		})
+	}
+	return lineup
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// hdhomerun only serves the device routes when the emulation is enabled, to
+// the allowed networks.
+func hdhomerun(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !currentConfig().HDHomeRun.Enabled {
+			http.NotFound(w, r)
+			return
+		}
+		if !hdhomerunAllowed(r) {
+			log.Printf("Access to HDHomeRun device denied: %s\n", clientIP(r))
+			http.Error(w, "Access Denied", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func hdhomerunDiscoverRequest(w http.ResponseWriter, r *http.Request) {
+
+	friendlyName := currentConfig().HDHomeRun.FriendlyName
+	if friendlyName == "" {
+		friendlyName = defaultFriendlyName
+	}
+
+	base := baseURL(r)
+	writeJSON(w, hdhomerunDiscover{
+		FriendlyName:    friendlyName,
+		Manufacturer:    "Silicondust",
+		ModelNumber:     hdhomerunModel,
+		FirmwareName:    hdhomerunFirmware,
+		FirmwareVersion: hdhomerunFirmwareVer,
+		DeviceID:        hdhomerunDeviceID(),
+		DeviceAuth:      defaultFriendlyName,
+		TunerCount:      hdhomerunTunerCount(),
+		BaseURL:         base,
+		LineupURL:       base + "/lineup.json",
+	})
+}
+
+func hdhomerunLineupRequest(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, hdhomerunLineup(baseURL(r)))
+}
+
+func hdhomerunLineupStatusRequest(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"ScanInProgress": 0,
+		"ScanPossible":   1,
+		"Source":         "Cable",
+		"SourceList":     []string{"Cable"},
+	})
+}
+
+// hdhomerunLineupPostRequest accepts the channel scans, the lineup being
+// always up to date.
+func hdhomerunLineupPostRequest(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func hdhomerunDeviceRequest(w http.ResponseWriter, r *http.Request) {
+
+	friendlyName := currentConfig().HDHomeRun.FriendlyName
+	if friendlyName == "" {
+		friendlyName = defaultFriendlyName
+	}
+
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(friendlyName))
+
+	deviceID := hdhomerunDeviceID()
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, hdhomerunXML, baseURL(r), escaped.String(), hdhomerunModel, hdhomerunModel, deviceID, deviceID)
+}
+
+// hdhomerunTuneRequest streams a channel as a continuous transport stream,
+// using one of the emulated tuners.
+func hdhomerunTuneRequest(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	number := mux.Vars(r)["number"]
+
+	var stream *streamStruct
+	for _, channel := range hdhomerunLineup(baseURL(r)) {
+		if channel.GuideNumber == number {
+			stream = channel.stream
+			break
+		}
+	}
+	if stream == nil {
+		http.Error(w, "Unknown channel", http.StatusNotFound)
+		return
+	}
+
+	tunersMutex.Lock()
+	if tunersInUse >= hdhomerunTunerCount() {
+		tunersMutex.Unlock()
+		log.Printf("No tuner left for channel %s\n", number)
+		w.Header().Set("X-HDHomeRun-Error", hdhomerunTunersInUse)
+		http.Error(w, "All tuners in use", http.StatusServiceUnavailable)
+		return
+	}
+	tunersInUse++
+	tunersMutex.Unlock()
+
+	defer func() {
+		tunersMutex.Lock()
+		tunersInUse--
+		tunersMutex.Unlock()
+	}()
+
+	// The media servers have no users, only the provider and host limits
+	// apply to them
+	sw, sr, done, err := openSession(w, r, stream, "")
+	if err != nil {
+		log.Printf("No stream left for channel %s: %s\n", number, err)
+		w.Header().Set("X-HDHomeRun-Error", hdhomerunTunersInUse)
+		http.Error(w, "All tuners in use", http.StatusServiceUnavailable)
+		return
+	}
+	defer done()
+
+	serveTransportStream(sw, sr, stream)
+}
+
+func registerHDHomeRunRoutes(r *mux.Router) *mux.Router {
+	r.HandleFunc("/discover.json", hdhomerun(hdhomerunDiscoverRequest))
+	r.HandleFunc("/lineup.json", hdhomerun(hdhomerunLineupRequest))
+	r.HandleFunc("/lineup_status.json", hdhomerun(hdhomerunLineupStatusRequest))
+	r.HandleFunc("/lineup.post", hdhomerun(hdhomerunLineupPostRequest))
+	r.HandleFunc("/device.xml", hdhomerun(hdhomerunDeviceRequest))
+	r.HandleFunc("/auto/v{number}", hdhomerun(hdhomerunTuneRequest))
+	return r
+}
@@ -0,0 +1,126 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package streamserver
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/a13labs/m3uproxy/pkg/m3uparser"
+)
+
+func TestDeviceIDValid(t *testing.T) {
+	tests := []struct {
+		id       uint32
+		expected bool
+	}{
+		{0x10100000, true},
+		{0x1040A2B5, true},
+		{0x12345674, true},
+		{0xFFFFFFFF, true},
+		{0x10100001, false},
+		{0x1040A2B4, false},
+		{0x12345678, false},
+		{0x00000001, false},
+	}
+
+	for _, test := range tests {
+		if got := deviceIDValid(test.id); got != test.expected {
+			t.Errorf("Unexpected validity of %08X. Expected: %v, Got: %v", test.id, test.expected, got)
+		}
+	}
+}
+
+func TestHDHomeRunDeviceID(t *testing.T) {
+	Config = &ServerConfig{Port: 8080}
+
+	var id uint32
+	if _, err := fmt.Sscanf(hdhomerunDeviceID(), "%08X", &id); err != nil || !deviceIDValid(id) {
+		t.Errorf("Unexpected derived device id: %s", hdhomerunDeviceID())
+	}
+
+	Config = &ServerConfig{HDHomeRun: HDHomeRunConfig{DeviceID: "1040a2b5"}}
+	if got := hdhomerunDeviceID(); got != "1040A2B5" {
+		t.Errorf("Unexpected device id. Expected: 1040A2B5, Got: %s", got)
+	}
+}
+
+func newLineupStream(index int, id, chno string, active bool) *streamStruct {
+	stream := &streamStruct{index: index, id: id, active: active, m3u: m3uparser.M3UEntry{Title: id}}
+	if chno != "" {
+		stream.m3u.TVGTags = m3uparser.M3UTvgTags{{Tag: "tvg-chno", Value: chno}}
+	}
+	return stream
+}
+
+func TestHDHomeRunLineupNumbers(t *testing.T) {
+	Config = &ServerConfig{}
+	defer func() { streams = make([]*streamStruct, 0) }()
+
+	lineupNumbers := func() map[string]string {
+		numbers := make(map[string]string)
+		for _, channel := range hdhomerunLineup("http://m3uproxy:8080") {
+			numbers[channel.stream.id] = channel.GuideNumber
+		}
+		return numbers
+	}
+
+	streams = []*streamStruct{
+		newLineupStream(0, "rtp1", "5", true),
+		newLineupStream(1, "rtp2", "", true),
+		newLineupStream(2, "sic", "", false),
+		newLineupStream(3, "tvi", "5", true),
+		newLineupStream(4, "cmtv", "", true),
+	}
+	before := lineupNumbers()
+
+	// Channels going offline must not renumber the others
+	streams[1].active = false
+	streams[2].active = true
+	after := lineupNumbers()
+
+	tests := []struct {
+		id       string
+		expected string
+	}{
+		{"rtp1", "5"},
+		{"rtp2", "7"},
+		{"sic", "8"},
+		{"tvi", "9"},
+		{"cmtv", "10"},
+	}
+
+	for _, test := range tests {
+		for _, numbers := range []map[string]string{before, after} {
+			if number, ok := numbers[test.id]; ok && number != test.expected {
+				t.Errorf("Unexpected number of %s. Expected: %s, Got: %s", test.id, test.expected, number)
+			}
+		}
+	}
+	if _, ok := before["sic"]; ok {
+		t.Error("Unexpected inactive channel in the lineup")
+	}
+	if len(before) != 4 || len(after) != 4 {
+		t.Errorf("Unexpected lineup sizes. Expected: 4, 4, Got: %d, %d", len(before), len(after))
+	}
+}
@@ -22,31 +22,82 @@ THE SOFTWARE.
 package streamserver
 
 import (
-	"encoding/base64"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"net/url"
-	"os"
 	"path"
-	"strings"
 	"time"
 
 	"github.com/a13labs/m3uproxy/pkg/m3uparser"
 	"github.com/elnormous/contenttype"
 )
 
-func executeRequest(method, URI string, transport *http.Transport, headers map[string]string) (*http.Response, error) {
+func executeRequest(method, URI string, client *http.Client, proxy string, headers map[string]string) (*http.Response, error) {
+	return executeRequestContext(context.Background(), method, URI, client, proxy, headers)
+}
+
+// executeRequestContext sends a request to the upstream server through
+// proxy, retrying the idempotent ones when the server fails, unless the
+// circuit breaker of the server through that proxy is open.
+func executeRequestContext(ctx context.Context, method, URI string, client *http.Client, proxy string, headers map[string]string) (*http.Response, error) {
+
+	host := breakerKey(URI, proxy)
+
+	retries := 0
+	if method == http.MethodGet || method == http.MethodHead {
+		retries = currentConfig().Retry.Attempts
+	}
+
+	for attempt := 0; ; attempt++ {
+
+		probe, err := allowRequest(host)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := sendRequest(ctx, method, URI, client, headers)
+
+		failed := isHostFailure(ctx, err)
+		switch {
+		case failed:
+			recordResult(host, probe, err)
+		case ctx.Err() == nil:
+			recordResult(host, probe, nil)
+		case probe:
+			releaseProbe(host)
+		}
+
+		if !failed || attempt >= retries {
+			return resp, err
+		}
 
-	client := &http.Client{
-		Timeout:   time.Duration(Config.Timeout) * time.Second,
-		Transport: transport,
+		delay := retryDelay(attempt, err)
+		log.Printf("Request to %s failed (%s), retrying in %s\n", host, err, delay.Round(time.Millisecond))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
 	}
+}
 
-	req, err := http.NewRequest(method, URI, nil)
+// sendRequest sends a single request to the upstream server. The server
+// must start answering within the upstream timeout, then may take as long
+// as needed to send the body, as long as it does not stall.
+func sendRequest(ctx context.Context, method, URI string, client *http.Client, headers map[string]string) (*http.Response, error) {
+
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	req, err := http.NewRequestWithContext(ctx, method, URI, nil)
 	if err != nil {
+		cancel(nil)
 		return nil, err
 	}
 
@@ -54,29 +105,39 @@ func executeRequest(method, URI string, transport *http.Transport, headers map[s
 		req.Header.Add(key, value)
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	var firstByte *time.Timer
+	if timeout := upstreamTimeout(URI); timeout > 0 {
+		firstByte = time.AfterFunc(timeout, func() {
+			cancel(errFirstByteTimeout)
+		})
 	}
 
-	code := resp.StatusCode / 100
-	if code != 2 {
-		return nil, errors.New("invalid server status code")
+	resp, err := client.Do(req)
+	if firstByte != nil {
+		firstByte.Stop()
+	}
+	if err != nil {
+		cancel(nil)
+		return nil, timeoutCause(ctx, err)
 	}
 
-	if resp.StatusCode == http.StatusNoContent {
-		return nil, errors.New("no content")
+	if resp.StatusCode/100 != 2 || resp.StatusCode == http.StatusNoContent {
+		resp.Body.Close()
+		cancel(nil)
+		return nil, &upstreamError{statusCode: resp.StatusCode, header: resp.Header}
 	}
 
+	resp.Body = newIdleBody(ctx, resp.Body, cancel, readTimeout())
 	return resp, nil
 }
 
-func verifyStream(mediaURI string, transport *http.Transport, headers map[string]string) bool {
+func verifyStream(mediaURI string, client *http.Client, proxy string, headers map[string]string) bool {
 
-	resp, err := executeRequest("GET", mediaURI, transport, headers)
+	resp, err := executeRequest("GET", mediaURI, client, proxy, headers)
 	if err != nil {
 		return false
 	}
+	defer resp.Body.Close()
 
 	ct := resp.Header.Get("Content-Type")
 	mediaType, _, err := contenttype.GetAcceptableMediaTypeFromHeader(ct, supportedMediaTypes)
@@ -85,6 +146,7 @@ func verifyStream(mediaURI string, transport *http.Transport, headers map[string
 	}
 
 	if mediaType.Subtype == "vnd.apple.mpegurl" || mediaType.Subtype == "x-mpegurl" {
+
 		m3uPlaylist, err := m3uparser.DecodeFromReader(resp.Body)
 		if err != nil {
 			return false
@@ -103,96 +165,192 @@ func verifyStream(mediaURI string, transport *http.Transport, headers map[string
 			uri.Path = path.Join(basePath, uri.Path)
 		}
 
-		return verifyStream(uri.String(), transport, headers)
+		return verifyStream(uri.String(), client, proxy, headers)
 	}
 
 	return true
 }
 
-func serveAndRemap(mediaURI string, transport *http.Transport, headers map[string]string, w http.ResponseWriter) {
-
-	resp, err := executeRequest("GET", mediaURI, transport, headers)
+func isPlaylistContentType(ct string) bool {
+	mediaType, _, err := contenttype.GetAcceptableMediaTypeFromHeader(ct, supportedMediaTypes)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return false
 	}
+	return mediaType.Subtype == "vnd.apple.mpegurl" || mediaType.Subtype == "x-mpegurl"
+}
 
-	ct := resp.Header.Get("Content-Type")
+// serveAndRemap serves an upstream resource, shared with the other viewers
+// requesting it, rewriting playlists so their URIs go through the proxy.
+// entryPoint is set for the stream URI itself, which may be a continuous
+// stream rather than a playlist.
+func serveAndRemap(w http.ResponseWriter, r *http.Request, stream *streamStruct, mediaURI string, entryPoint bool) {
+
+	var resp *sharedResponse
+	client, proxy := stream.route()
+
+	// Byte ranges and HEAD requests are only answered locally from the cache
+	if r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+		if entry, ok := getSegmentCache().Get(sharedKey(mediaURI, proxy)); ok {
+			resp = responseFromCache(entry)
+		} else if servePassthrough(w, r, stream, mediaURI) {
+			return
+		}
+	}
+
+	if resp == nil {
+		var err error
+		resp, err = fetchShared(r.Context(), mediaURI, client, proxy, stream.headers, entryPoint)
+		if errors.Is(err, errBodyTooLarge) && servePassthrough(w, r, stream, mediaURI) {
+			return
+		}
+		if err != nil {
+			writeUpstreamError(w, err)
+			return
+		}
+	}
+
+	ct := resp.header.Get("Content-Type")
 	mediaType, _, err := contenttype.GetAcceptableMediaTypeFromHeader(ct, supportedMediaTypes)
 	if err != nil {
 		w.WriteHeader(http.StatusUnsupportedMediaType)
 		return
 	}
 
+	if resp.broadcast != nil && entryPoint && currentConfig().Packaging.Enabled {
+		if p, ok := getPackager(mediaURI, resp.broadcast); ok {
+			p.servePlaylist(w, r)
+			return
+		}
+	}
+
 	w.Header().Set("Content-Type", ct)
+
+	if resp.broadcast != nil {
+		copyUpstreamHeaders(w, resp.header, false)
+		serveBroadcast(w, r, resp.broadcast)
+		return
+	}
+
 	if mediaType.Subtype == "vnd.apple.mpegurl" || mediaType.Subtype == "x-mpegurl" {
 
-		m3uPlaylist, err := m3uparser.DecodeFromReader(resp.Body)
+		copyUpstreamHeaders(w, resp.header, true)
+
+		m3uPlaylist, err := m3uparser.DecodeFromReader(bytes.NewReader(resp.body))
 
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		resp.Body.Close()
 
 		var filePrefix string
 
 		switch m3uPlaylist.Type {
 		case "master":
-			filePrefix = "master.m3u8"
+			filePrefix = remapPlaylistFile
 		case "media":
-			filePrefix = "media.ts"
+			filePrefix = remapSegmentFile
 		default:
 			log.Printf("Unknown m3u8 playlist type: %v\n", m3uPlaylist.Type)
 			return
 		}
 
-		for i := range m3uPlaylist.Entries {
-			uri, _ := url.Parse(m3uPlaylist.Entries[i].URI)
-
-			if uri.Scheme == "" {
-				uri.Scheme = resp.Request.URL.Scheme
-				uri.Host = resp.Request.URL.Host
-				basePath := path.Dir(resp.Request.URL.Path)
-				uri.Path = path.Join(basePath, uri.Path)
-			}
-
-			remap := base64.URLEncoding.EncodeToString([]byte(uri.String()))
-			m3uPlaylist.Entries[i].URI = fmt.Sprintf("%s?cache=%s", filePrefix, remap)
+		if err := remapPlaylist(m3uPlaylist, stream.id, resp.finalURL, filePrefix); err != nil {
+			log.Printf("Error remapping playlist of stream %s: %s\n", stream.id, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
 
 		m3uPlaylist.WriteTo(w)
 	} else {
-		io.Copy(w, resp.Body)
+		copyUpstreamHeaders(w, resp.header, false)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(resp.body))
 	}
 }
 
-func loadContent(filePath string) (string, error) {
-	if strings.HasPrefix(filePath, "http://") || strings.HasPrefix(filePath, "https://") {
-		// Load content from URL
-		resp, err := http.Get(filePath)
-		if err != nil {
-			return "", err
-		}
-		defer resp.Body.Close()
+// The names given to the remapped URIs, by kind of resource.
+const (
+	remapPlaylistFile = "master.m3u8"
+	remapSegmentFile  = "media.ts"
+	remapKeyFile      = "key.bin"
+	remapInitFile     = "init.mp4"
+)
 
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return "", err
+// uriTags are the tags carrying an URI attribute, with the kind of resource
+// it points to.
+var uriTags = map[string]string{
+	"EXT-X-KEY":                remapKeyFile,
+	"EXT-X-SESSION-KEY":        remapKeyFile,
+	"EXT-X-MAP":                remapInitFile,
+	"EXT-X-MEDIA":              remapPlaylistFile,
+	"EXT-X-I-FRAME-STREAM-INF": remapPlaylistFile,
+	"EXT-X-RENDITION-REPORT":   remapPlaylistFile,
+	"EXT-X-PART":               remapSegmentFile,
+	"EXT-X-PRELOAD-HINT":       remapSegmentFile,
+}
+
+// remapPlaylist points the entries, and the URI attributes of the tags, of a
+// playlist to the proxy. Relative URIs are resolved against base.
+func remapPlaylist(playlist *m3uparser.M3UPlaylist, streamID string, base *url.URL, entryFile string) error {
+
+	if err := remapTags(playlist.Tags, streamID, base); err != nil {
+		return err
+	}
+	if err := remapTags(playlist.Trailer, streamID, base); err != nil {
+		return err
+	}
+
+	for i := range playlist.Entries {
+		if err := remapTags(playlist.Entries[i].Tags, streamID, base); err != nil {
+			return err
 		}
-		return string(body), nil
-	} else {
-		// Load content from local file
-		file, err := os.Open(filePath)
+		uri, err := remapURI(playlist.Entries[i].URI, streamID, base, entryFile)
 		if err != nil {
-			return "", err
+			return err
 		}
-		defer file.Close()
+		playlist.Entries[i].URI = uri
+	}
+	return nil
+}
 
-		body, err := io.ReadAll(file)
+func remapTags(tags m3uparser.M3UTags, streamID string, base *url.URL) error {
+	for i := range tags {
+		file, ok := uriTags[tags[i].Tag]
+		if !ok {
+			continue
+		}
+		value, ok := tags[i].GetAttribute("URI")
+		if !ok {
+			continue
+		}
+		if hint, _ := tags[i].GetAttribute("TYPE"); tags[i].Tag == "EXT-X-PRELOAD-HINT" && hint == "MAP" {
+			file = remapInitFile
+		}
+		uri, err := remapURI(value, streamID, base, file)
 		if err != nil {
-			return "", err
+			return err
 		}
-		return string(body), nil
+		tags[i].SetAttribute("URI", uri)
+	}
+	return nil
+}
+
+// remapURI seals an upstream URI in a proxy URI named after file. URIs
+// which are not fetched over HTTP, e.g. data or skd URIs, are kept.
+func remapURI(rawURI, streamID string, base *url.URL, file string) (string, error) {
+
+	uri, err := url.Parse(rawURI)
+	if err != nil {
+		return "", err
+	}
+
+	uri = base.ResolveReference(uri)
+	if uri.Scheme != "http" && uri.Scheme != "https" {
+		return rawURI, nil
+	}
+
+	remap, err := sealRemap(streamID, uri.String())
+	if err != nil {
+		return "", err
 	}
+	return fmt.Sprintf("%s?cache=%s", file, remap), nil
 }
@@ -0,0 +1,90 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package streamserver
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+)
+
+// legacyIndex maps the position of each stream in the playlists served
+// before stable ids to its id. It is saved next to the playlist the first
+// time the streams are loaded and never rebuilt, so an index keeps pointing
+// to the stream it was issued for whatever the playlist becomes. Guarded by
+// streamsMutex.
+var legacyIndex []string
+
+func legacyIndexPath() string {
+	return currentConfig().Playlist + ".index.json"
+}
+
+// loadLegacyIndex reads the saved mapping or, on the first run, saves the
+// one of the given streams. Must be called with streamsMutex held.
+func loadLegacyIndex(streamList []*streamStruct) {
+
+	if legacyIndex != nil || currentConfig().DisableIndexRedirect {
+		return
+	}
+
+	path := legacyIndexPath()
+	if content, err := os.ReadFile(path); err == nil {
+		index := make([]string, 0)
+		if err := json.Unmarshal(content, &index); err != nil {
+			log.Printf("Failed to parse legacy index %s: %s\n", path, err)
+			return
+		}
+		legacyIndex = index
+		return
+	} else if !os.IsNotExist(err) {
+		log.Printf("Failed to read legacy index %s: %s\n", path, err)
+		return
+	}
+
+	index := make([]string, len(streamList))
+	for i, stream := range streamList {
+		index[i] = stream.id
+	}
+
+	content, err := json.Marshal(index)
+	if err == nil {
+		err = os.WriteFile(path, content, 0644)
+	}
+	if err != nil {
+		log.Printf("Failed to save legacy index %s: %s\n", path, err)
+		return
+	}
+	legacyIndex = index
+}
+
+// legacyStreamID returns the id the stream at index had when the legacy
+// index was saved, or an empty string if it is unknown or no longer exists.
+// Must be called with streamsMutex held.
+func legacyStreamID(index int) string {
+	if currentConfig().DisableIndexRedirect || index < 0 || index >= len(legacyIndex) {
+		return ""
+	}
+	if _, ok := streamsByID[legacyIndex[index]]; !ok {
+		return ""
+	}
+	return legacyIndex[index]
+}
@@ -0,0 +1,123 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package streamserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/a13labs/m3uproxy/pkg/auth"
+	"github.com/gorilla/mux"
+)
+
+func TestLegacyRedirect(t *testing.T) {
+	Config = &ServerConfig{Playlist: filepath.Join(t.TempDir(), "playlist.m3u")}
+	defer func() {
+		legacyIndex = nil
+		streamsByID = make(map[string]*streamStruct)
+	}()
+
+	first := []*streamStruct{{id: "rtp1.pt"}, {id: "rtp2.pt"}, {id: "sic.pt"}}
+	legacyIndex = nil
+	loadLegacyIndex(first)
+	if _, err := os.Stat(legacyIndexPath()); err != nil {
+		t.Fatalf("Expected the legacy index to be saved: %v", err)
+	}
+
+	// The playlist changed since: the index must keep pointing to the
+	// streams it was saved for
+	streamsByID = map[string]*streamStruct{"sic.pt": first[2], "rtp1.pt": first[0], "tvi.pt": {id: "tvi.pt"}}
+	legacyIndex = nil
+	loadLegacyIndex([]*streamStruct{first[2], first[0]})
+
+	tests := []struct {
+		streamID string
+		found    bool
+		redirect string
+	}{
+		{"rtp1.pt", true, ""},
+		{"0", false, "rtp1.pt"},
+		{"2", false, "sic.pt"},
+		{"1", false, ""},
+		{"3", false, ""},
+		{"-1", false, ""},
+		{"unknown", false, ""},
+	}
+
+	for _, test := range tests {
+		stream, redirect := lookupStream(test.streamID)
+		if (stream != nil) != test.found || redirect != test.redirect {
+			t.Errorf("Unexpected lookup of '%s'. Expected: %v, '%s', Got: %v, '%s'", test.streamID, test.found, test.redirect, stream != nil, redirect)
+		}
+	}
+
+	Config = &ServerConfig{Playlist: Config.Playlist, DisableIndexRedirect: true}
+	if _, redirect := lookupStream("0"); redirect != "" {
+		t.Errorf("Unexpected redirect with the index redirect disabled: %s", redirect)
+	}
+}
+
+func TestLegacyRedirectTarget(t *testing.T) {
+	if err := auth.InitializeAuth([]byte(`{"provider": "null", "secret_key": "secret"}`)); err != nil {
+		t.Fatalf("Failed to initialize auth: %v", err)
+	}
+	token, err := auth.CreateToken("viewer", "password")
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+
+	Config = &ServerConfig{}
+	legacyIndex = []string{"rtp1.pt"}
+	streamsByID = map[string]*streamStruct{"rtp1.pt": {id: "rtp1.pt"}}
+	defer func() {
+		legacyIndex = nil
+		streamsByID = make(map[string]*streamStruct)
+	}()
+
+	tests := []struct {
+		path     string
+		query    string
+		expected string
+	}{
+		{"master.m3u8", "", "/" + token + "/rtp1.pt/master.m3u8"},
+		{"chunks/1.ts", "", "/" + token + "/rtp1.pt/chunks/1.ts"},
+		{"master.m3u8", "_HLS_msn=10", "/" + token + "/rtp1.pt/master.m3u8?_HLS_msn=10"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/"+token+"/0/"+test.path+"?"+test.query, nil)
+		r = mux.SetURLVars(r, map[string]string{"token": token, "streamId": "0", "path": test.path})
+		w := httptest.NewRecorder()
+		streamRequest(w, r)
+
+		if w.Code != http.StatusTemporaryRedirect {
+			t.Errorf("Unexpected status for %s. Expected: %d, Got: %d", test.path, http.StatusTemporaryRedirect, w.Code)
+		}
+		if location := w.Header().Get("Location"); location != test.expected {
+			t.Errorf("Unexpected redirect for %s. Expected: %s, Got: %s", test.path, test.expected, location)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package streamserver
+
+import (
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultBlockingReloadTimeout leaves room for the three target durations
+// an upstream server may hold a blocking playlist reload.
+const defaultBlockingReloadTimeout = 30
+
+// blockingReloadPrefix starts the query parameters of the Low-Latency HLS
+// delivery directives: _HLS_msn, _HLS_part and _HLS_skip.
+const blockingReloadPrefix = "_HLS_"
+
+// forwardDeliveryDirectives adds the delivery directives of a client request
+// to the upstream playlist URI.
+func forwardDeliveryDirectives(uri string, query url.Values) string {
+
+	directives := url.Values{}
+	for key, values := range query {
+		if strings.HasPrefix(key, blockingReloadPrefix) {
+			directives[key] = values
+		}
+	}
+	if len(directives) == 0 {
+		return uri
+	}
+
+	upstream, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+
+	upstreamQuery := upstream.Query()
+	for key, values := range directives {
+		upstreamQuery[key] = values
+	}
+	upstream.RawQuery = upstreamQuery.Encode()
+	return upstream.String()
+}
+
+// isBlockingReload tells whether an upstream request waits for a playlist
+// update, the upstream server holding it until the update is available.
+func isBlockingReload(uri string) bool {
+	upstream, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	return upstream.Query().Has(blockingReloadPrefix + "msn")
+}
+
+// upstreamTimeout is how long the upstream server may take to answer a
+// request for uri, until the response headers are received.
+func upstreamTimeout(uri string) time.Duration {
+	if !isBlockingReload(uri) {
+		return time.Duration(currentConfig().Timeout) * time.Second
+	}
+	if currentConfig().BlockingReloadTimeout > 0 {
+		return time.Duration(currentConfig().BlockingReloadTimeout) * time.Second
+	}
+	return defaultBlockingReloadTimeout * time.Second
+}
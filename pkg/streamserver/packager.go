@@ -0,0 +1,297 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package streamserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/a13labs/m3uproxy/pkg/mpegts"
+)
+
+const (
+	defaultSegmentDuration  = 4
+	defaultPlaylistSegments = 6
+	// extraSegments are kept once out of the playlist for late clients.
+	extraSegments = 3
+	// packagerIdleTime stops packaging a stream nobody asked for since.
+	packagerIdleTime = 30 * time.Second
+	// packagedPrefix starts the paths of the packaged segments.
+	packagedPrefix = "live/"
+)
+
+type packagedSegment struct {
+	sequence int64
+	mpegts.Segment
+}
+
+// hlsPackager splits a continuous transport stream in a rolling window of
+// HLS segments, reading the stream from the broadcaster shared with its
+// other viewers.
+type hlsPackager struct {
+	uri                   string
+	mux                   sync.Mutex
+	segments              []packagedSegment
+	sequence              int64
+	discontinuitySequence int64
+	updated               chan struct{}
+	lastAccess            time.Time
+	closed                bool
+}
+
+var (
+	packagers      = make(map[string]*hlsPackager)
+	packagersMutex sync.Mutex
+)
+
+// getPackager returns the packager of an upstream, starting one reading
+// from the broadcaster when given.
+func getPackager(uri string, b *broadcaster) (*hlsPackager, bool) {
+	packagersMutex.Lock()
+	defer packagersMutex.Unlock()
+
+	if p, ok := packagers[uri]; ok {
+		return p, true
+	}
+	if b == nil {
+		return nil, false
+	}
+
+	ch, ok := b.subscribe()
+	if !ok {
+		return nil, false
+	}
+
+	p := &hlsPackager{
+		uri:        uri,
+		updated:    make(chan struct{}),
+		lastAccess: time.Now(),
+	}
+	packagers[uri] = p
+	log.Printf("Packaging %s in HLS segments\n", uri)
+	go p.run(b, ch)
+	return p, true
+}
+
+func segmentDurationTarget() time.Duration {
+	if currentConfig().Packaging.SegmentDuration > 0 {
+		return time.Duration(currentConfig().Packaging.SegmentDuration) * time.Second
+	}
+	return defaultSegmentDuration * time.Second
+}
+
+func playlistSegments() int {
+	if currentConfig().Packaging.PlaylistSegments > 0 {
+		return currentConfig().Packaging.PlaylistSegments
+	}
+	return defaultPlaylistSegments
+}
+
+func (p *hlsPackager) run(b *broadcaster, ch chan []byte) {
+
+	defer p.close()
+
+	segmenter := mpegts.NewSegmenter(segmentDurationTarget(), p.add)
+	ticker := time.NewTicker(packagerIdleTime / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case chunk, ok := <-ch:
+			if !ok {
+				segmenter.Flush()
+				return
+			}
+			segmenter.Write(chunk)
+		case <-ticker.C:
+			if p.idle() {
+				log.Printf("Nobody watching %s, stopping packaging\n", p.uri)
+				b.unsubscribe(ch)
+				return
+			}
+		}
+	}
+}
+
+func (p *hlsPackager) add(segment mpegts.Segment) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.segments = append(p.segments, packagedSegment{sequence: p.sequence, Segment: segment})
+	p.sequence++
+
+	if drop := len(p.segments) - playlistSegments() - extraSegments; drop > 0 {
+		for _, old := range p.segments[:drop] {
+			if old.Discontinuity {
+				p.discontinuitySequence++
+			}
+		}
+		p.segments = append([]packagedSegment(nil), p.segments[drop:]...)
+	}
+
+	close(p.updated)
+	p.updated = make(chan struct{})
+}
+
+func (p *hlsPackager) close() {
+	packagersMutex.Lock()
+	if packagers[p.uri] == p {
+		delete(packagers, p.uri)
+	}
+	packagersMutex.Unlock()
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.closed = true
+	close(p.updated)
+	p.updated = make(chan struct{})
+}
+
+func (p *hlsPackager) idle() bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return time.Since(p.lastAccess) > packagerIdleTime
+}
+
+// wait blocks, up to timeout, until ready holds. ready is called with p.mux
+// held, which is held on return.
+func (p *hlsPackager) wait(ctx context.Context, ready func() bool, timeout time.Duration) {
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	p.mux.Lock()
+	for !ready() && !p.closed {
+		updated := p.updated
+		p.mux.Unlock()
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			p.mux.Lock()
+			return
+		case <-timer.C:
+			p.mux.Lock()
+			return
+		}
+		p.mux.Lock()
+	}
+}
+
+// servePlaylist serves the media playlist of the last segments, waiting for
+// the first one when packaging just started.
+func (p *hlsPackager) servePlaylist(w http.ResponseWriter, r *http.Request) {
+
+	p.wait(r.Context(), func() bool { return len(p.segments) > 0 }, packagedSegmentTimeout())
+	defer p.mux.Unlock()
+
+	p.lastAccess = time.Now()
+	if len(p.segments) == 0 {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	start := max(0, len(p.segments)-playlistSegments())
+	discontinuitySequence := p.discontinuitySequence
+	for _, segment := range p.segments[:start] {
+		if segment.Discontinuity {
+			discontinuitySequence++
+		}
+	}
+
+	targetDuration := 1
+	for _, segment := range p.segments[start:] {
+		targetDuration = max(targetDuration, int(math.Ceil(segment.Duration.Seconds())))
+	}
+
+	var playlist bytes.Buffer
+	fmt.Fprintf(&playlist, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n", targetDuration, p.segments[start].sequence)
+	if discontinuitySequence > 0 {
+		fmt.Fprintf(&playlist, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuitySequence)
+	}
+	for _, segment := range p.segments[start:] {
+		if segment.Discontinuity {
+			playlist.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&playlist, "#EXTINF:%.3f,\n%s%d.ts\n", segment.Duration.Seconds(), packagedPrefix, segment.sequence)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(playlist.Bytes())
+}
+
+// serveSegment serves a packaged segment, waiting for the one in progress.
+func (p *hlsPackager) serveSegment(w http.ResponseWriter, r *http.Request, name string) {
+
+	var sequence int64
+	if _, err := fmt.Sscanf(strings.TrimPrefix(name, packagedPrefix), "%d.ts", &sequence); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var data []byte
+	p.wait(r.Context(), func() bool {
+		if len(p.segments) == 0 || sequence > p.sequence {
+			// Not about to be produced, give up
+			return true
+		}
+		first := p.segments[0].sequence
+		if sequence >= first && sequence < p.sequence {
+			data = p.segments[sequence-first].Data
+		}
+		return sequence < p.sequence
+	}, packagedSegmentTimeout())
+	p.lastAccess = time.Now()
+	p.mux.Unlock()
+
+	if data == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// packagedSegmentTimeout is the longest a segment may take to be produced,
+// the segmenter cutting segments without keyframes past three targets.
+func packagedSegmentTimeout() time.Duration {
+	return 3 * segmentDurationTarget()
+}
+
+// servePackagedSegment serves a segment of a stream being packaged.
+func servePackagedSegment(w http.ResponseWriter, r *http.Request, stream *streamStruct, name string) {
+	p, ok := getPackager(stream.m3u.URI, nil)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	p.serveSegment(w, r, name)
+}
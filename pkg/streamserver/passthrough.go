@@ -0,0 +1,185 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package streamserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/elnormous/contenttype"
+)
+
+// defaultPassthroughHeaders are the upstream response headers forwarded to
+// clients when the server configuration doesn't list them.
+var defaultPassthroughHeaders = []string{
+	"Content-Length",
+	"Cache-Control",
+	"Expires",
+	"Last-Modified",
+	"ETag",
+	"Accept-Ranges",
+}
+
+// rewrittenHeaders describe the upstream body byte for byte, they are never
+// forwarded along with a rewritten playlist.
+var rewrittenHeaders = map[string]bool{
+	"Content-Length": true,
+	"Content-Range":  true,
+	"Accept-Ranges":  true,
+	"ETag":           true,
+}
+
+// upstreamError is returned when the upstream server answers with a status
+// code other than a successful one.
+type upstreamError struct {
+	statusCode int
+	header     http.Header
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("invalid server status code %d", e.statusCode)
+}
+
+func passthroughHeaders() []string {
+	if currentConfig().PassthroughHeaders != nil {
+		return currentConfig().PassthroughHeaders
+	}
+	return defaultPassthroughHeaders
+}
+
+// copyUpstreamHeaders forwards the allowed upstream response headers, the
+// ones bound to the upstream body are skipped when it was rewritten.
+func copyUpstreamHeaders(w http.ResponseWriter, header http.Header, rewritten bool) {
+	for _, name := range passthroughHeaders() {
+		name = http.CanonicalHeaderKey(name)
+		if rewritten && rewrittenHeaders[name] {
+			continue
+		}
+		if values := header.Values(name); len(values) > 0 {
+			w.Header()[name] = append([]string(nil), values...)
+		}
+	}
+}
+
+// writeUpstreamError answers with the status code that best describes the
+// upstream failure.
+func writeUpstreamError(w http.ResponseWriter, err error) {
+
+	var statusErr *upstreamError
+	var openErr *circuitOpenError
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &openErr):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(openErr.retryAfter.Seconds()))))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case errors.As(err, &statusErr):
+		code := statusErr.statusCode
+		switch {
+		case code == http.StatusNoContent,
+			code == http.StatusForbidden,
+			code == http.StatusNotFound,
+			code == http.StatusGone,
+			code == http.StatusRequestedRangeNotSatisfiable:
+		case code == http.StatusTooManyRequests, code >= 500:
+			if retryAfter := statusErr.header.Get("Retry-After"); retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+		default:
+			code = http.StatusBadGateway
+		}
+		if code == http.StatusRequestedRangeNotSatisfiable {
+			if contentRange := statusErr.header.Get("Content-Range"); contentRange != "" {
+				w.Header().Set("Content-Range", contentRange)
+			}
+		}
+		w.WriteHeader(code)
+	case errors.Is(err, context.Canceled):
+		// The client went away, nobody is left to answer
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		w.WriteHeader(http.StatusGatewayTimeout)
+	default:
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// servePassthrough relays a request to the upstream server without sharing
+// nor caching it, forwarding its method and byte range. It reports false,
+// without writing anything, when the upstream answered a GET with a playlist
+// which has to be fetched whole to be rewritten.
+func servePassthrough(w http.ResponseWriter, r *http.Request, stream *streamStruct, mediaURI string) bool {
+
+	headers := make(map[string]string, len(stream.headers)+2)
+	for key, value := range stream.headers {
+		headers[key] = value
+	}
+	for _, key := range []string{"Range", "If-Range"} {
+		if value := r.Header.Get(key); value != "" {
+			headers[key] = value
+		}
+	}
+
+	client, proxy := stream.route()
+	resp, err := executeRequestContext(r.Context(), r.Method, mediaURI, client, proxy, headers)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return true
+	}
+	defer resp.Body.Close()
+
+	ct := resp.Header.Get("Content-Type")
+	if _, _, err := contenttype.GetAcceptableMediaTypeFromHeader(ct, supportedMediaTypes); err != nil {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return true
+	}
+
+	playlist := isPlaylistContentType(ct)
+	if playlist && r.Method != http.MethodHead {
+		return false
+	}
+
+	w.Header().Set("Content-Type", ct)
+	copyUpstreamHeaders(w, resp.Header, playlist)
+	if resp.StatusCode == http.StatusPartialContent {
+		w.Header().Set("Content-Range", resp.Header.Get("Content-Range"))
+		if resp.ContentLength >= 0 {
+			w.Header().Set("Content-Length", fmt.Sprint(resp.ContentLength))
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	if r.Method == http.MethodHead {
+		return true
+	}
+
+	if _, err := io.Copy(w, resp.Body); err != nil && r.Context().Err() == nil {
+		log.Printf("Error relaying %s: %s\n", mediaURI, err)
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package streamserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWriteUpstreamError(t *testing.T) {
+	retryAfter := http.Header{"Retry-After": []string{"120"}}
+
+	tests := []struct {
+		name       string
+		err        error
+		status     int
+		retryAfter string
+	}{
+		{"not found", &upstreamError{statusCode: http.StatusNotFound}, http.StatusNotFound, ""},
+		{"forbidden", &upstreamError{statusCode: http.StatusForbidden}, http.StatusForbidden, ""},
+		{"gone", &upstreamError{statusCode: http.StatusGone}, http.StatusGone, ""},
+		{"other client error", &upstreamError{statusCode: http.StatusUnauthorized}, http.StatusBadGateway, ""},
+		{"rate limited", &upstreamError{statusCode: http.StatusTooManyRequests, header: retryAfter}, http.StatusTooManyRequests, "120"},
+		{"server error", &upstreamError{statusCode: http.StatusServiceUnavailable, header: retryAfter}, http.StatusServiceUnavailable, "120"},
+		{"internal error", &upstreamError{statusCode: http.StatusInternalServerError, header: http.Header{}}, http.StatusInternalServerError, ""},
+		{"wrapped status", fmt.Errorf("fetching: %w", &upstreamError{statusCode: http.StatusNotFound}), http.StatusNotFound, ""},
+		{"deadline", context.DeadlineExceeded, http.StatusGatewayTimeout, ""},
+		{"first byte timeout", errFirstByteTimeout, http.StatusGatewayTimeout, ""},
+		{"read timeout", fmt.Errorf("relaying: %w", errReadTimeout), http.StatusGatewayTimeout, ""},
+		{"open breaker", &circuitOpenError{host: "iptv.example.com", retryAfter: 1500 * time.Millisecond}, http.StatusServiceUnavailable, "2"},
+		{"body too large", errBodyTooLarge, http.StatusBadGateway, ""},
+		{"connection refused", errors.New("connection refused"), http.StatusBadGateway, ""},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		writeUpstreamError(w, test.err)
+
+		if w.Code != test.status {
+			t.Errorf("%s: unexpected status. Expected: %d, Got: %d", test.name, test.status, w.Code)
+		}
+		if got := w.Header().Get("Retry-After"); got != test.retryAfter {
+			t.Errorf("%s: unexpected Retry-After. Expected: '%s', Got: '%s'", test.name, test.retryAfter, got)
+		}
+	}
+}
@@ -39,7 +39,7 @@ var (
 
 func LoadPlaylist() error {
 	var err error
-	playlistConfig, err = m3uprovider.LoadPlaylistConfig(Config.Playlist)
+	playlistConfig, err = m3uprovider.LoadPlaylistConfig(currentConfig().Playlist)
 	if err != nil {
 		return err
 	}
@@ -48,8 +48,29 @@ func LoadPlaylist() error {
 	if err != nil {
 		return err
 	}
+	matchEpgChannels(m3uCache)
 
-	log.Printf("Loaded %d streams from %s\n", m3uCache.StreamCount(), Config.Playlist)
+	log.Printf("Loaded %d streams from %s\n", m3uCache.StreamCount(), currentConfig().Playlist)
+	return nil
+}
+
+func RefreshPlaylist(name string) error {
+	if playlistConfig == nil {
+		var err error
+		playlistConfig, err = m3uprovider.LoadPlaylistConfig(currentConfig().Playlist)
+		if err != nil {
+			return err
+		}
+	}
+
+	playlist, err := m3uprovider.Refresh(playlistConfig, name)
+	if err != nil {
+		return err
+	}
+	matchEpgChannels(playlist)
+	m3uCache = playlist
+
+	log.Printf("Refreshed provider %s, %d streams in playlist\n", name, m3uCache.StreamCount())
 	return nil
 }
 
@@ -58,7 +79,7 @@ func SavePlaylist(p m3uprovider.PlaylistConfig) error {
 		return fmt.Errorf("invalid playlist config")
 	}
 	playlistConfig = &p
-	return playlistConfig.SaveToFile(Config.Playlist)
+	return playlistConfig.SaveToFile(currentConfig().Playlist)
 }
 
 func registerPlaylistRoutes(r *mux.Router) *mux.Router {
@@ -77,39 +98,21 @@ func playlistRequest(w http.ResponseWriter, r *http.Request) {
 	authParts := strings.SplitN(authHeader, " ", 2)
 	token := authParts[1]
 
-	scheme := r.Header.Get("X-Forwarded-Proto")
-	if scheme == "" {
-		scheme = r.URL.Scheme
-	}
-	if scheme == "" {
-		scheme = "http"
-	}
+	base := baseURL(r)
+	profile := selectProfile(r, token)
+	granted := getEntitlement(token)
 
 	streamsMutex.Lock()
 	defer streamsMutex.Unlock()
 	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("#EXTM3U\n"))
-	for i, stream := range streams {
-		if !stream.active {
+	for _, stream := range streams {
+		if !stream.active || !granted.allows(stream) {
 			continue
 		}
 
-		uri := fmt.Sprintf("%s://%s/%s/%d/%s", scheme, r.Host, token, i, m3uPlaylist)
-		if stream.disableRemap {
-			uri = stream.m3u.URI
-		}
-
-		entry := m3uparser.M3UEntry{
-			URI:   uri,
-			Title: stream.m3u.Title,
-			Tags:  make([]m3uparser.M3UTag, 0),
-		}
-		entry.Tags = append(entry.Tags, stream.m3u.Tags...)
-		if !stream.radio {
-			entry.AddTag("KODIPROP", "inputstream=inputstream.adaptive")
-			entry.AddTag("KODIPROP", "inputstream.adaptive.manifest_type=hls")
-		}
+		entry := profile.renderEntry(stream, base, token)
 		w.Write([]byte(entry.String() + "\n"))
 	}
 }
@@ -0,0 +1,231 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package streamserver
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/a13labs/m3uproxy/pkg/auth"
+	"github.com/a13labs/m3uproxy/pkg/m3uparser"
+)
+
+// URL styles of the playlist entries.
+const (
+	// URLStyleHLS points the entries to the proxied HLS stream.
+	URLStyleHLS = "hls"
+	// URLStyleTS points the entries to the continuous transport stream.
+	URLStyleTS = "ts"
+	// URLStyleDirect points the entries to the upstream URL.
+	URLStyleDirect = "direct"
+)
+
+const defaultProfile = "generic"
+
+// ProfileTag is a tag added to the playlist entries of a profile.
+type ProfileTag struct {
+	Tag   string `json:"tag"`
+	Value string `json:"value"`
+}
+
+// ClientProfile describes how the playlist is rendered for a kind of client.
+type ClientProfile struct {
+	// Tags are added to the entries of the streams which are not radios.
+	Tags []ProfileTag `json:"tags,omitempty"`
+	// Attributes lists the tvg attributes kept in the EXTINF tags, all of
+	// them when empty.
+	Attributes []string `json:"attributes,omitempty"`
+	URLStyle   string   `json:"url_style,omitempty"`
+	// VLCOptions adds EXTVLCOPT tags with the headers of the streams.
+	VLCOptions bool `json:"vlc_options,omitempty"`
+	// UserAgents are the User-Agent substrings identifying the clients.
+	UserAgents []string `json:"user_agents,omitempty"`
+}
+
+// kodiTags make Kodi play the streams with inputstream.adaptive.
+var kodiTags = []ProfileTag{
+	{"KODIPROP", "inputstream=inputstream.adaptive"},
+	{"KODIPROP", "inputstream.adaptive.manifest_type=hls"},
+}
+
+var builtinProfiles = map[string]ClientProfile{
+	"kodi": {
+		Tags:       kodiTags,
+		URLStyle:   URLStyleHLS,
+		UserAgents: []string{"Kodi"},
+	},
+	"vlc": {
+		URLStyle:   URLStyleHLS,
+		VLCOptions: true,
+		UserAgents: []string{"VLC", "LibVLC"},
+	},
+	"tivimate": {
+		URLStyle:   URLStyleHLS,
+		UserAgents: []string{"TiviMate"},
+	},
+	"plex": {
+		Attributes: []string{"tvg-id", "tvg-name", "tvg-logo", "tvg-chno", "group-title"},
+		URLStyle:   URLStyleTS,
+		UserAgents: []string{"Plex", "Lavf"},
+	},
+	defaultProfile: {
+		URLStyle: URLStyleHLS,
+	},
+}
+
+// getProfile returns a profile defined in the configuration, or else a
+// builtin one.
+func getProfile(name string) (ClientProfile, bool) {
+	if profile, ok := currentConfig().Profiles.Definitions[name]; ok {
+		return profile, true
+	}
+	profile, ok := builtinProfiles[name]
+	return profile, ok
+}
+
+// selectProfile picks the profile of a playlist request: the one asked with
+// ?profile=, else the one of the user or of its role, else the one matching
+// the User-Agent, else the default one.
+func selectProfile(r *http.Request, token string) ClientProfile {
+
+	candidates := []string{r.URL.Query().Get("profile")}
+
+	if user, err := auth.GetUserFromToken(token); err == nil {
+		candidates = append(candidates, currentConfig().Profiles.Users[user])
+	}
+	if role, err := auth.GetRoleFromToken(token); err == nil {
+		candidates = append(candidates, currentConfig().Profiles.Roles[role])
+	}
+	candidates = append(candidates, detectProfile(r.UserAgent()), currentConfig().Profiles.Default, defaultProfile)
+
+	for _, name := range candidates {
+		if profile, ok := getProfile(name); name != "" && ok {
+			return profile
+		}
+	}
+	return builtinProfiles[defaultProfile]
+}
+
+// detectProfile looks for the profile of a User-Agent, the configured
+// profiles first.
+func detectProfile(userAgent string) string {
+
+	if userAgent == "" {
+		return ""
+	}
+
+	for _, profiles := range []map[string]ClientProfile{currentConfig().Profiles.Definitions, builtinProfiles} {
+		names := make([]string, 0, len(profiles))
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			for _, agent := range profiles[name].UserAgents {
+				if strings.Contains(userAgent, agent) {
+					return name
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// renderEntry renders the playlist entry of a stream for a profile.
+func (profile ClientProfile) renderEntry(stream *streamStruct, base, token string) m3uparser.M3UEntry {
+
+	var uri string
+	switch {
+	case stream.disableRemap || profile.URLStyle == URLStyleDirect:
+		uri = stream.m3u.URI
+	case profile.URLStyle == URLStyleTS:
+		uri = fmt.Sprintf("%s/%s/%s/stream.ts", base, token, stream.id)
+	default:
+		uri = fmt.Sprintf("%s/%s/%s/%s", base, token, stream.id, m3uPlaylist)
+	}
+
+	tvgTags := stream.m3u.TVGTags
+	if len(profile.Attributes) > 0 {
+		tvgTags = nil
+		for _, tag := range stream.m3u.TVGTags {
+			if slices.Contains(profile.Attributes, tag.Tag) {
+				tvgTags = append(tvgTags, tag)
+			}
+		}
+	}
+
+	entry := m3uparser.M3UEntry{
+		URI:      uri,
+		Duration: stream.m3u.Duration,
+		Title:    stream.m3u.Title,
+		Tags: []m3uparser.M3UTag{
+			{Tag: "EXTINF", Value: fmt.Sprintf("%d %s,%s", stream.m3u.Duration, strings.TrimSpace(tvgTags.String()), stream.m3u.Title)},
+		},
+		TVGTags: tvgTags,
+	}
+
+	for _, tag := range stream.m3u.Tags {
+		switch {
+		case tag.Tag == "EXTINF", tag.Tag == "EXTVLCOPT", tag.Tag == "KODIPROP":
+			// Rendered by the profile
+		case strings.HasPrefix(tag.Tag, "M3UPROXY"):
+			// Proxy settings, not meant for the clients
+		default:
+			entry.Tags = append(entry.Tags, tag)
+		}
+	}
+
+	if profile.VLCOptions {
+		if userAgent := stream.headers["User-Agent"]; userAgent != "" {
+			entry.AddTag("EXTVLCOPT", "http-user-agent="+userAgent)
+		}
+		if referrer := stream.headers["Referer"]; referrer != "" {
+			entry.AddTag("EXTVLCOPT", "http-referrer="+referrer)
+		}
+	}
+
+	if stream.radio {
+		return entry
+	}
+
+	tags := profile.Tags
+	if stream.forceKodiHeaders && !hasKodiTags(tags) {
+		tags = append(append([]ProfileTag(nil), tags...), kodiTags...)
+	}
+	for _, tag := range tags {
+		entry.AddTag(tag.Tag, tag.Value)
+	}
+	return entry
+}
+
+func hasKodiTags(tags []ProfileTag) bool {
+	for _, tag := range tags {
+		if tag.Tag == "KODIPROP" {
+			return true
+		}
+	}
+	return false
+}
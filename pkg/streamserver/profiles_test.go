@@ -0,0 +1,146 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package streamserver
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/a13labs/m3uproxy/pkg/m3uparser"
+)
+
+func TestSelectProfile(t *testing.T) {
+	custom := ClientProfile{URLStyle: URLStyleDirect, UserAgents: []string{"Kodi/21"}}
+	Config = &ServerConfig{
+		Profiles: ProfilesConfig{
+			Definitions: map[string]ClientProfile{"custom": custom},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		userAgent string
+		query     string
+		expected  ClientProfile
+	}{
+		{"kodi", "Kodi/20.2 (Linux; Android 11)", "", builtinProfiles["kodi"]},
+		{"vlc", "VLC/3.0.18 LibVLC/3.0.18", "", builtinProfiles["vlc"]},
+		{"libvlc", "LibVLC/3.0.20", "", builtinProfiles["vlc"]},
+		{"tivimate", "TiviMate/4.7.0 (Android 12)", "", builtinProfiles["tivimate"]},
+		{"plex", "Lavf/60.3.100", "", builtinProfiles["plex"]},
+		{"configured profiles first", "Kodi/21.0 (Windows)", "", custom},
+		{"unknown agent", "curl/8.4.0", "", builtinProfiles[defaultProfile]},
+		{"no agent", "", "", builtinProfiles[defaultProfile]},
+		{"asked profile", "Kodi/20.2", "profile=plex", builtinProfiles["plex"]},
+		{"unknown asked profile", "VLC/3.0.18", "profile=missing", builtinProfiles["vlc"]},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/m3u/playlist.m3u?"+test.query, nil)
+		r.Header.Set("User-Agent", test.userAgent)
+		if got := selectProfile(r, ""); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s: unexpected profile. Expected: %+v, Got: %+v", test.name, test.expected, got)
+		}
+	}
+
+	Config.Profiles.Default = "plex"
+	r := httptest.NewRequest("GET", "/m3u/playlist.m3u", nil)
+	r.Header.Set("User-Agent", "curl/8.4.0")
+	if got := selectProfile(r, ""); !reflect.DeepEqual(got, builtinProfiles["plex"]) {
+		t.Errorf("Unexpected profile with a configured default. Expected: plex, Got: %+v", got)
+	}
+}
+
+func TestRenderEntry(t *testing.T) {
+	const base, token = "http://m3uproxy:8080", "token"
+
+	stream := &streamStruct{
+		id:      "rtp1.pt",
+		headers: map[string]string{"User-Agent": "Mozilla/5.0", "Referer": "http://example.com/"},
+		m3u: m3uparser.M3UEntry{
+			URI:      "http://iptv.example.com/rtp1/index.m3u8",
+			Duration: -1,
+			Title:    "RTP 1",
+			TVGTags: m3uparser.M3UTvgTags{
+				{Tag: "tvg-id", Value: "rtp1.pt"},
+				{Tag: "tvg-shift", Value: "1"},
+				{Tag: "group-title", Value: "News"},
+			},
+			Tags: []m3uparser.M3UTag{
+				{Tag: "EXTINF", Value: "-1,RTP 1"},
+				{Tag: "EXTGRP", Value: "News"},
+				{Tag: "M3UPROXYHEADER", Value: "User-Agent=Mozilla/5.0"},
+				{Tag: "KODIPROP", Value: "inputstream=inputstream.ffmpegdirect"},
+			},
+		},
+	}
+
+	tests := []struct {
+		profile string
+		uri     string
+		extinf  string
+		tags    map[string]int
+	}{
+		{defaultProfile, base + "/token/rtp1.pt/master.m3u8", `-1 tvg-id="rtp1.pt" tvg-shift="1" group-title="News",RTP 1`,
+			map[string]int{"EXTINF": 1, "EXTGRP": 1}},
+		{"kodi", base + "/token/rtp1.pt/master.m3u8", `-1 tvg-id="rtp1.pt" tvg-shift="1" group-title="News",RTP 1`,
+			map[string]int{"EXTINF": 1, "EXTGRP": 1, "KODIPROP": 2}},
+		{"vlc", base + "/token/rtp1.pt/master.m3u8", `-1 tvg-id="rtp1.pt" tvg-shift="1" group-title="News",RTP 1`,
+			map[string]int{"EXTINF": 1, "EXTGRP": 1, "EXTVLCOPT": 2}},
+		{"plex", base + "/token/rtp1.pt/stream.ts", `-1 tvg-id="rtp1.pt" group-title="News",RTP 1`,
+			map[string]int{"EXTINF": 1, "EXTGRP": 1}},
+		{"direct", "http://iptv.example.com/rtp1/index.m3u8", `-1 tvg-id="rtp1.pt" tvg-shift="1" group-title="News",RTP 1`,
+			map[string]int{"EXTINF": 1, "EXTGRP": 1}},
+	}
+
+	Config = &ServerConfig{
+		Profiles: ProfilesConfig{
+			Definitions: map[string]ClientProfile{"direct": {URLStyle: URLStyleDirect}},
+		},
+	}
+
+	for _, test := range tests {
+		profile, _ := getProfile(test.profile)
+		entry := profile.renderEntry(stream, base, token)
+
+		if entry.URI != test.uri {
+			t.Errorf("%s: unexpected URI. Expected: %s, Got: %s", test.profile, test.uri, entry.URI)
+		}
+
+		tags := make(map[string]int)
+		for _, tag := range entry.Tags {
+			tags[tag.Tag]++
+			if tag.Tag == "EXTINF" && tag.Value != test.extinf {
+				t.Errorf("%s: unexpected EXTINF. Expected: %s, Got: %s", test.profile, test.extinf, tag.Value)
+			}
+			if strings.HasPrefix(tag.Tag, "M3UPROXY") || tag.Value == "inputstream=inputstream.ffmpegdirect" {
+				t.Errorf("%s: unexpected tag sent to the client: %s:%s", test.profile, tag.Tag, tag.Value)
+			}
+		}
+		if !reflect.DeepEqual(tags, test.tags) {
+			t.Errorf("%s: unexpected tags. Expected: %v, Got: %v", test.profile, test.tags, tags)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package streamserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/a13labs/m3uproxy/pkg/fetch"
+)
+
+const (
+	defaultPoolCheckURL      = "http://www.gstatic.com/generate_204"
+	defaultPoolCheckInterval = 30
+	defaultPoolCheckTimeout  = 10
+	defaultPoolFailures      = 2
+)
+
+// poolMember is a proxy of a pool, with the outcome of its health checks.
+type poolMember struct {
+	Proxy     string    `json:"proxy"`
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"failures"`
+	LastCheck time.Time `json:"last_check,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type proxyPool struct {
+	name    string
+	config  ProxyPoolConfig
+	members []*poolMember
+	// assigned is the member each stream of a round robin pool was given,
+	// next the member the following stream gets.
+	assigned map[string]*poolMember
+	next     int
+	mutex    sync.Mutex
+	stop     chan bool
+}
+
+var (
+	proxyPools      = make(map[string]*proxyPool)
+	proxyPoolsMutex sync.RWMutex
+)
+
+var errUnknownProxyPool = errors.New("unknown proxy pool")
+
+// unknownPoolTransport fails the requests of the streams whose proxy pool
+// is not configured, rather than connecting them directly.
+type unknownPoolTransport struct {
+	name string
+}
+
+func (t unknownPoolTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("%w %s", errUnknownProxyPool, t.name)
+}
+
+// configureProxyPools replaces the running proxy pools with the configured
+// ones, and starts checking the health of their members.
+func configureProxyPools() error {
+
+	pools := make(map[string]*proxyPool, len(currentConfig().ProxyPools))
+	for name, config := range currentConfig().ProxyPools {
+		if len(config.Proxies) == 0 {
+			return fmt.Errorf("proxy pool %s has no proxies", name)
+		}
+		if config.Selection != "" && config.Selection != PoolSelectionRoundRobin && config.Selection != PoolSelectionSticky {
+			return fmt.Errorf("proxy pool %s: unknown selection %s", name, config.Selection)
+		}
+		pool := &proxyPool{
+			name:     name,
+			config:   config,
+			assigned: make(map[string]*poolMember),
+			stop:     make(chan bool),
+		}
+		for _, proxy := range config.Proxies {
+			if _, err := fetch.ParseProxies(proxy); err != nil {
+				return fmt.Errorf("proxy pool %s: %w", name, err)
+			}
+			pool.members = append(pool.members, &poolMember{Proxy: proxy, Healthy: true})
+		}
+		pools[name] = pool
+	}
+
+	proxyPoolsMutex.Lock()
+	for _, pool := range proxyPools {
+		close(pool.stop)
+	}
+	proxyPools = pools
+	for _, pool := range proxyPools {
+		go pool.run()
+	}
+	proxyPoolsMutex.Unlock()
+
+	disableUnknownPoolStreams(pools)
+	return nil
+}
+
+// disableUnknownPoolStreams takes the streams whose proxy pool is gone
+// offline at once, their next health check brings them back if it returns.
+func disableUnknownPoolStreams(pools map[string]*proxyPool) {
+
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+
+	for _, stream := range streams {
+		if _, ok := pools[stream.proxyPool]; stream.proxyPool == "" || ok {
+			continue
+		}
+		stream.mux.Lock()
+		if stream.active {
+			log.Printf("Proxy pool %s of stream '%s' removed, stream disabled\n", stream.proxyPool, stream.m3u.Title)
+		}
+		stream.active = false
+		stream.mux.Unlock()
+	}
+}
+
+func stopProxyPools() {
+	proxyPoolsMutex.Lock()
+	defer proxyPoolsMutex.Unlock()
+
+	for _, pool := range proxyPools {
+		close(pool.stop)
+	}
+	proxyPools = make(map[string]*proxyPool)
+}
+
+// proxyPoolConfigured tells whether the named pool exists.
+func proxyPoolConfigured(name string) bool {
+	proxyPoolsMutex.RLock()
+	defer proxyPoolsMutex.RUnlock()
+	_, ok := proxyPools[name]
+	return ok
+}
+
+// poolProxy returns the proxy of the named pool a request of stream goes
+// through.
+func poolProxy(name, streamID string) (string, bool) {
+
+	proxyPoolsMutex.RLock()
+	pool, ok := proxyPools[name]
+	proxyPoolsMutex.RUnlock()
+	if !ok {
+		return "", false
+	}
+	return pool.selectProxy(streamID), true
+}
+
+// selectProxy picks a healthy member, or any member when none is healthy.
+// Sticky pools rank the members by a hash of the stream, round robin pools
+// give each stream the next member in turn; either way a stream only moves
+// when its member fails.
+func (p *proxyPool) selectProxy(streamID string) string {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	candidates := make([]*poolMember, 0, len(p.members))
+	for _, member := range p.members {
+		if member.Healthy {
+			candidates = append(candidates, member)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.members
+	}
+
+	if p.config.Selection == PoolSelectionSticky {
+		var best *poolMember
+		var bestScore uint64
+		for _, member := range candidates {
+			h := fnv.New64a()
+			h.Write([]byte(member.Proxy + "\x00" + streamID))
+			if score := h.Sum64(); best == nil || score > bestScore {
+				best, bestScore = member, score
+			}
+		}
+		return best.Proxy
+	}
+
+	if member, ok := p.assigned[streamID]; ok {
+		for _, candidate := range candidates {
+			if candidate == member {
+				return member.Proxy
+			}
+		}
+	}
+
+	p.next = (p.next + 1) % len(candidates)
+	p.assigned[streamID] = candidates[p.next]
+	return candidates[p.next].Proxy
+}
+
+func (p *proxyPool) run() {
+
+	interval := time.Duration(p.config.CheckInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultPoolCheckInterval * time.Second
+	}
+
+	p.check()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.check()
+		}
+	}
+}
+
+// check fetches the check URL through every member of the pool.
+func (p *proxyPool) check() {
+
+	checkURL := p.config.CheckURL
+	if checkURL == "" {
+		checkURL = defaultPoolCheckURL
+	}
+	timeout := time.Duration(p.config.CheckTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultPoolCheckTimeout * time.Second
+	}
+	failures := p.config.Failures
+	if failures <= 0 {
+		failures = defaultPoolFailures
+	}
+
+	var wg sync.WaitGroup
+	for _, member := range p.members {
+		wg.Add(1)
+		go func(member *poolMember) {
+			defer wg.Done()
+			err := checkProxy(member.Proxy, checkURL, timeout)
+
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+
+			member.LastCheck = time.Now()
+			if err == nil {
+				if !member.Healthy {
+					log.Printf("Proxy %s of pool %s is back\n", member.Proxy, p.name)
+				}
+				member.Healthy = true
+				member.Failures = 0
+				member.LastError = ""
+				return
+			}
+
+			member.Failures++
+			member.LastError = err.Error()
+			if member.Healthy && member.Failures >= failures {
+				log.Printf("Proxy %s of pool %s removed: %s\n", member.Proxy, p.name, err)
+				member.Healthy = false
+			}
+		}(member)
+	}
+	wg.Wait()
+}
+
+func checkProxy(proxy, checkURL string, timeout time.Duration) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := upstreamClient(proxy).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("check answered %s", resp.Status)
+	}
+	return nil
+}
+
+// proxyPoolStatus is the view of a pool given by the admin API.
+type proxyPoolStatus struct {
+	Name      string       `json:"name"`
+	Selection string       `json:"selection"`
+	Members   []poolMember `json:"members"`
+}
+
+func proxyPoolsAPIRequest(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case http.MethodGet:
+		proxyPoolsMutex.RLock()
+		list := make([]proxyPoolStatus, 0, len(proxyPools))
+		for name, pool := range proxyPools {
+			status := proxyPoolStatus{Name: name, Selection: pool.config.Selection}
+			if status.Selection == "" {
+				status.Selection = PoolSelectionRoundRobin
+			}
+			pool.mutex.Lock()
+			for _, member := range pool.members {
+				status.Members = append(status.Members, *member)
+			}
+			pool.mutex.Unlock()
+			list = append(list, status)
+		}
+		proxyPoolsMutex.RUnlock()
+
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Name < list[j].Name
+		})
+		writeJSON(w, list)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package streamserver
+
+import (
+	"testing"
+)
+
+func newTestPool(selection string, proxies ...string) *proxyPool {
+	pool := &proxyPool{
+		name:     "test",
+		config:   ProxyPoolConfig{Proxies: proxies, Selection: selection},
+		assigned: make(map[string]*poolMember),
+	}
+	for _, proxy := range proxies {
+		pool.members = append(pool.members, &poolMember{Proxy: proxy, Healthy: true})
+	}
+	return pool
+}
+
+func setHealthy(pool *proxyPool, proxy string, healthy bool) {
+	for _, member := range pool.members {
+		if member.Proxy == proxy {
+			member.Healthy = healthy
+		}
+	}
+}
+
+func TestSelectProxyRoundRobin(t *testing.T) {
+	tests := []struct {
+		name      string
+		unhealthy []string
+		streams   []string
+		expected  []string
+	}{
+		{"streams given the members in turn", nil, []string{"a", "b", "c", "a", "b"}, []string{"p2", "p3", "p1", "p2", "p3"}},
+		{"unhealthy members skipped", []string{"p2"}, []string{"a", "b", "c"}, []string{"p3", "p1", "p3"}},
+		{"every member used when none is healthy", []string{"p1", "p2", "p3"}, []string{"a", "b"}, []string{"p2", "p3"}},
+	}
+
+	for _, test := range tests {
+		pool := newTestPool(PoolSelectionRoundRobin, "p1", "p2", "p3")
+		for _, proxy := range test.unhealthy {
+			setHealthy(pool, proxy, false)
+		}
+		for i, stream := range test.streams {
+			if proxy := pool.selectProxy(stream); proxy != test.expected[i] {
+				t.Errorf("%s: unexpected proxy for %s. Expected: %s, Got: %s", test.name, stream, test.expected[i], proxy)
+			}
+		}
+	}
+}
+
+func TestSelectProxyFailover(t *testing.T) {
+	tests := []struct {
+		selection string
+		// back tells whether the stream returns to its first member once
+		// it is healthy again.
+		back bool
+	}{
+		{PoolSelectionRoundRobin, false},
+		{PoolSelectionSticky, true},
+	}
+
+	for _, test := range tests {
+		pool := newTestPool(test.selection, "p1", "p2", "p3")
+
+		first := pool.selectProxy("a")
+		for i := 0; i < 3; i++ {
+			if proxy := pool.selectProxy("a"); proxy != first {
+				t.Errorf("%s: stream moved while its member is healthy. Expected: %s, Got: %s", test.selection, first, proxy)
+			}
+		}
+
+		setHealthy(pool, first, false)
+		moved := pool.selectProxy("a")
+		if moved == first {
+			t.Errorf("%s: stream kept its failed member %s", test.selection, first)
+		}
+
+		setHealthy(pool, first, true)
+		expected := moved
+		if test.back {
+			expected = first
+		}
+		if proxy := pool.selectProxy("a"); proxy != expected {
+			t.Errorf("%s: unexpected proxy once the member recovered. Expected: %s, Got: %s", test.selection, expected, proxy)
+		}
+	}
+}
+
+func TestSharedKey(t *testing.T) {
+	direct := sharedKey("http://example.com/a.ts", "")
+	first := sharedKey("http://example.com/a.ts", "socks5://first:1080")
+	second := sharedKey("http://example.com/a.ts", "socks5://second:1080")
+	if direct == first || first == second {
+		t.Errorf("Fetches through different proxies should not be shared: %q, %q, %q", direct, first, second)
+	}
+}
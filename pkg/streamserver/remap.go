@@ -0,0 +1,165 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package streamserver
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRemapTTL = 24 * 60 * 60
+
+	// remapBuckets is the number of expiry buckets per TTL, a token stays
+	// the same within a bucket and is valid between one and 1.25 TTL.
+	remapBuckets = 4
+)
+
+var (
+	errInvalidRemap = errors.New("invalid remap token")
+	errExpiredRemap = errors.New("expired remap token")
+
+	remapCipher      cipher.AEAD
+	remapNonceKey    []byte
+	remapCipherMutex sync.Mutex
+)
+
+// configureRemap derives the key sealing the upstream URIs handed out in
+// remapped playlists. Without a configured secret a random one is used, and
+// remapped URIs do not survive a restart.
+func configureRemap() error {
+
+	secret := []byte(currentConfig().RemapSecret)
+	if len(secret) == 0 {
+		log.Println("No remap secret configured, using a random one")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+	}
+
+	key := sha256.Sum256(append([]byte("m3uproxy-remap:"), secret...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	nonceKey := sha256.Sum256(append([]byte("m3uproxy-remap-nonce:"), secret...))
+
+	remapCipherMutex.Lock()
+	remapCipher = aead
+	remapNonceKey = nonceKey[:]
+	remapCipherMutex.Unlock()
+	return nil
+}
+
+func getRemapCipher() (cipher.AEAD, []byte) {
+	remapCipherMutex.Lock()
+	defer remapCipherMutex.Unlock()
+	return remapCipher, remapNonceKey
+}
+
+func remapTTL() time.Duration {
+	if currentConfig().RemapTTL > 0 {
+		return time.Duration(currentConfig().RemapTTL) * time.Second
+	}
+	return defaultRemapTTL * time.Second
+}
+
+// remapExpiry rounds the expiry of a token issued now up to the end of its
+// bucket, so the same URI gets the same token for the whole bucket.
+func remapExpiry(now time.Time) int64 {
+	ttl := int64(remapTTL() / time.Second)
+	bucket := ttl / remapBuckets
+	if bucket < 1 {
+		bucket = 1
+	}
+	expires := now.Unix() + ttl
+	return (expires + bucket - 1) / bucket * bucket
+}
+
+// sealRemap returns an opaque token for an upstream URI, bound to the stream
+// it belongs to and valid until the remap TTL elapses. The nonce is derived
+// from the stream, the URI and the expiry, so refetching a playlist yields
+// the same tokens and the segment URLs stay cacheable.
+func sealRemap(streamID, uri string) (string, error) {
+
+	aead, nonceKey := getRemapCipher()
+	if aead == nil {
+		return "", errors.New("remap not configured")
+	}
+
+	plaintext := make([]byte, 8, 8+len(uri))
+	binary.BigEndian.PutUint64(plaintext, uint64(remapExpiry(time.Now())))
+	plaintext = append(plaintext, uri...)
+
+	mac := hmac.New(sha256.New, nonceKey)
+	mac.Write([]byte(streamID))
+	mac.Write([]byte{0})
+	mac.Write(plaintext)
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(streamID))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// openRemap returns the upstream URI of a token issued by sealRemap for the
+// same stream.
+func openRemap(streamID, token string) (string, error) {
+
+	aead, _ := getRemapCipher()
+	if aead == nil {
+		return "", errInvalidRemap
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errInvalidRemap
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(streamID))
+	if err != nil || len(plaintext) < 8 {
+		return "", errInvalidRemap
+	}
+
+	expires := time.Unix(int64(binary.BigEndian.Uint64(plaintext[:8])), 0)
+	if time.Now().After(expires) {
+		return "", errExpiredRemap
+	}
+
+	return string(plaintext[8:]), nil
+}
@@ -0,0 +1,105 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package streamserver
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// sealExpired seals uri with an expiry in the past, as sealRemap would have
+// done a TTL ago.
+func sealExpired(streamID, uri string) string {
+	aead, _ := getRemapCipher()
+	nonce := make([]byte, aead.NonceSize())
+	plaintext := make([]byte, 8, 8+len(uri))
+	binary.BigEndian.PutUint64(plaintext, uint64(time.Now().Add(-time.Minute).Unix()))
+	plaintext = append(plaintext, uri...)
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, []byte(streamID)))
+}
+
+func TestRemap(t *testing.T) {
+	const uri = "http://iptv.example.com/live/channel1/index.m3u8"
+
+	tests := []struct {
+		name     string
+		token    func() string
+		rotate   bool
+		streamID string
+		err      error
+	}{
+		{"round trip", func() string { token, _ := sealRemap("channel1", uri); return token }, false, "channel1", nil},
+		{"different stream rejected", func() string { token, _ := sealRemap("channel1", uri); return token }, false, "channel2", errInvalidRemap},
+		{"tampered token rejected", func() string {
+			token, _ := sealRemap("channel1", uri)
+			sealed, _ := base64.RawURLEncoding.DecodeString(token)
+			sealed[len(sealed)-1] ^= 0xff
+			return base64.RawURLEncoding.EncodeToString(sealed)
+		}, false, "channel1", errInvalidRemap},
+		{"expired token rejected", func() string { return sealExpired("channel1", uri) }, false, "channel1", errExpiredRemap},
+		{"rotated secret rejected", func() string { token, _ := sealRemap("channel1", uri); return token }, true, "channel1", errInvalidRemap},
+	}
+
+	for _, test := range tests {
+		Config = &ServerConfig{RemapSecret: "secret"}
+		if err := configureRemap(); err != nil {
+			t.Fatalf("Unexpected error configuring remap: %v", err)
+		}
+
+		token := test.token()
+		if test.rotate {
+			Config = &ServerConfig{RemapSecret: "rotated"}
+			if err := configureRemap(); err != nil {
+				t.Fatalf("Unexpected error configuring remap: %v", err)
+			}
+		}
+
+		got, err := openRemap(test.streamID, token)
+		if err != test.err {
+			t.Errorf("%s: unexpected error. Expected: %v, Got: %v", test.name, test.err, err)
+		}
+		if err == nil && got != uri {
+			t.Errorf("%s: unexpected URI. Expected: %s, Got: %s", test.name, uri, got)
+		}
+	}
+}
+
+func TestSealRemapDeterministic(t *testing.T) {
+	Config = &ServerConfig{RemapSecret: "secret"}
+	if err := configureRemap(); err != nil {
+		t.Fatalf("Unexpected error configuring remap: %v", err)
+	}
+
+	first, _ := sealRemap("channel1", "http://iptv.example.com/live/1.ts")
+	second, _ := sealRemap("channel1", "http://iptv.example.com/live/1.ts")
+	if first != second {
+		t.Errorf("Unexpected token change. Expected: %s, Got: %s", first, second)
+	}
+
+	other, _ := sealRemap("channel2", "http://iptv.example.com/live/1.ts")
+	if other == first {
+		t.Errorf("Unexpected token shared by two streams: %s", other)
+	}
+}
@@ -5,103 +5,124 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/oschwald/geoip2-golang"
 )
 
-var geoipDb *geoip2.Reader
-var geoipWhitelist map[string]bool
-var geoIPCidrWhitelist []*net.IPNet
+var (
+	geoipDb            *geoip2.Reader
+	geoipWhitelist     map[string]bool
+	geoIPCidrWhitelist []*net.IPNet
+	corsDomains        []string
+	securityMutex      sync.RWMutex
+)
 
 func configureSecurity() error {
 
-	var err error
-
-	if Config.Security.GeoIP.Database == "" {
-		return nil
-	}
+	config := currentConfig().Security
 
-	geoipDb, err = geoip2.Open(Config.Security.GeoIP.Database)
-	if err != nil {
-		geoipDb = nil
-		return err
-	}
+	// Everything is built aside and only swapped in once it is complete, a
+	// failed reload keeps the rules already in place.
+	var db *geoip2.Reader
+	whitelist := make(map[string]bool)
+	cidrWhitelist := make([]*net.IPNet, 0)
 
-	geoipWhitelist = make(map[string]bool)
-	for _, country := range Config.Security.GeoIP.Whitelist {
-		geoipWhitelist[country] = true
-	}
+	if config.GeoIP.Database != "" {
+		for _, country := range config.GeoIP.Whitelist {
+			whitelist[country] = true
+		}
 
-	geoIPCidrWhitelist = make([]*net.IPNet, 0)
+		for _, cidr := range config.GeoIP.InternalNetworks {
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return err
+			}
+			cidrWhitelist = append(cidrWhitelist, ipnet)
+		}
 
-	for _, cidr := range Config.Security.GeoIP.InternalNetworks {
-		_, ipnet, err := net.ParseCIDR(cidr)
+		var err error
+		db, err = geoip2.Open(config.GeoIP.Database)
 		if err != nil {
 			return err
 		}
-		geoIPCidrWhitelist = append(geoIPCidrWhitelist, ipnet)
 	}
 
+	securityMutex.Lock()
+	defer securityMutex.Unlock()
+
+	if geoipDb != nil {
+		geoipDb.Close()
+	}
+
+	corsDomains = config.AllowedCORSDomains
+	if len(corsDomains) > 0 {
+		log.Println("CORS enabled")
+	}
+
+	geoipDb = db
+	geoipWhitelist = whitelist
+	geoIPCidrWhitelist = cidrWhitelist
+
+	if db != nil {
+		log.Println("GeoIP enabled")
+	}
 	return nil
 }
 
 func cleanGeoIp() {
+	securityMutex.Lock()
+	defer securityMutex.Unlock()
 	if geoipDb != nil {
 		geoipDb.Close()
+		geoipDb = nil
 	}
 }
 
+// secure applies the security rules in place at the time of each request, so
+// they can be rebuilt by configureSecurity without replacing the handler.
 func secure(next http.Handler) http.Handler {
 
-	if len(Config.Security.AllowedCORSDomains) > 0 {
-		next = cors(next)
-	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-	if geoipDb == nil {
-		return next
-	}
+		securityMutex.RLock()
+		enableCors := len(corsDomains) > 0
+		securityMutex.RUnlock()
+
+		if enableCors {
+			cors(geoip(next)).ServeHTTP(w, r)
+			return
+		}
+		geoip(next).ServeHTTP(w, r)
+	})
+}
 
-	log.Println("GeoIP enabled")
+func geoip(next http.Handler) http.Handler {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		ip := ""
-		if r.Header.Get("X-Real-IP") != "" {
-			ip = r.Header.Get("X-Real-IP")
-		} else if r.Header.Get("X-Forwarded-For") != "" {
-			ips := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
-			ip = ips[0]
-		} else {
-			var err error
-			ip, _, err = net.SplitHostPort(r.RemoteAddr)
-			if err != nil {
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-				return
-			}
+		securityMutex.RLock()
+		enabled := geoipDb != nil
+		securityMutex.RUnlock()
+
+		if !enabled {
+			next.ServeHTTP(w, r)
+			return
 		}
 
+		ip := clientIP(r)
 		if ip == "" {
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
 
-		parsedIP := net.ParseIP(ip)
-
-		for _, ipnet := range geoIPCidrWhitelist {
-			if ipnet.Contains(parsedIP) {
-				next.ServeHTTP(w, r)
-				return
-			}
-		}
-
-		record, err := geoipDb.Country(parsedIP)
+		countryCode, allowed, err := checkGeoIP(net.ParseIP(ip))
 		if err != nil {
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
 
-		countryCode := record.Country.IsoCode
-		if _, ok := geoipWhitelist[countryCode]; !ok {
+		if !allowed {
 			log.Printf("Access Denied: %s, Country: %s\n", ip, countryCode)
 			http.Error(w, "Access Denied", http.StatusForbidden)
 			return
@@ -111,11 +132,55 @@ func secure(next http.Handler) http.Handler {
 	})
 }
 
+// clientIP returns the address of the client, as reported by the reverse
+// proxy in front of the server if any.
+func clientIP(r *http.Request) string {
+	if ip := r.Header.Get("X-Real-IP"); ip != "" {
+		return ip
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return ip
+}
+
+func checkGeoIP(ip net.IP) (string, bool, error) {
+
+	securityMutex.RLock()
+	defer securityMutex.RUnlock()
+
+	if geoipDb == nil {
+		return "", true, nil
+	}
+
+	for _, ipnet := range geoIPCidrWhitelist {
+		if ipnet.Contains(ip) {
+			return "", true, nil
+		}
+	}
+
+	record, err := geoipDb.Country(ip)
+	if err != nil {
+		return "", false, err
+	}
+
+	countryCode := record.Country.IsoCode
+	_, ok := geoipWhitelist[countryCode]
+	return countryCode, ok, nil
+}
+
 func cors(next http.Handler) http.Handler {
-	log.Println("CORS enabled")
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		w.Header().Set("Access-Control-Allow-Origin", strings.Join(Config.Security.AllowedCORSDomains, ","))
+		securityMutex.RLock()
+		allowedOrigins := strings.Join(corsDomains, ",")
+		securityMutex.RUnlock()
+
+		w.Header().Set("Access-Control-Allow-Origin", allowedOrigins)
 		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS, POST, PUT, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "authorization")
 		if r.Method == http.MethodOptions {
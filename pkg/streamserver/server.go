@@ -26,7 +26,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"strings"
@@ -41,9 +40,10 @@ import (
 
 var (
 	streams           = make([]*streamStruct, 0)
+	streamsByID       = make(map[string]*streamStruct)
 	streamsMutex      sync.Mutex
+	loadStreamsMutex  sync.Mutex
 	stopStreamLoading = make(chan bool)
-	restartServer     = make(chan bool)
 	running           = false
 
 	updateTimer *time.Timer
@@ -53,17 +53,40 @@ const m3uPlaylist = "master.m3u8"
 
 func LoadStreams() error {
 
+	loadStreamsMutex.Lock()
+	defer loadStreamsMutex.Unlock()
+
 	if err := LoadPlaylist(); err != nil {
 		return err
 	}
 
+	return loadStreams()
+}
+
+// RefreshProvider fetches a single provider again and rebuilds the streams
+// from the merged playlist.
+func RefreshProvider(name string) error {
+
+	loadStreamsMutex.Lock()
+	defer loadStreamsMutex.Unlock()
+
+	if err := RefreshPlaylist(name); err != nil {
+		return err
+	}
+
+	return loadStreams()
+}
+
+func loadStreams() error {
+
 	streamList := make([]*streamStruct, 0)
+	ids := make(map[string]bool)
 
 	var wg sync.WaitGroup
 	var streamsChan = make(chan *streamStruct)
 
 	stopWorkers := make(chan bool)
-	for i := 0; i < Config.NumWorkers; i++ {
+	for i := 0; i < currentConfig().NumWorkers; i++ {
 		wg.Add(1)
 		go monitorWorker(streamsChan, stopWorkers, &wg)
 	}
@@ -87,29 +110,25 @@ func LoadStreams() error {
 				}
 
 				proxy := ""
+				proxyPool := ""
 				m3uproxyTags := entry.SearchTags("M3UPROXYTRANSPORT")
 				if len(m3uproxyTags) > 0 {
-					parts := strings.Split(m3uproxyTags[0].Value, "=")
+					parts := strings.SplitN(m3uproxyTags[0].Value, "=", 2)
 					if len(parts) == 2 {
 						switch parts[0] {
 						case "proxy":
 							proxy = parts[1]
+						case "pool":
+							proxyPool = parts[1]
+							if _, ok := currentConfig().ProxyPools[proxyPool]; !ok {
+								log.Printf("Unknown proxy pool %s for %s, stream disabled\n", proxyPool, entry.Title)
+							}
 						default:
 							log.Printf("Unknown M3UPROXYTRANSPORT tag: %s\n", parts[0])
 						}
 					}
 				}
 
-				transport := http.DefaultTransport.(*http.Transport)
-				if proxy != "" {
-					proxyURL, err := url.Parse(proxy)
-					if err == nil {
-						transport = &http.Transport{
-							Proxy: http.ProxyURL(proxyURL),
-						}
-					}
-				}
-
 				headers := make(map[string]string)
 				m3uproxyTags = entry.SearchTags("M3UPROXYHEADER")
 				for _, tag := range m3uproxyTags {
@@ -150,20 +169,40 @@ func LoadStreams() error {
 					}
 				}
 
+				provider := ""
+				if providerTags := entry.SearchTags("M3UPROXYPROVIDER"); len(providerTags) > 0 {
+					provider = providerTags[0].Value
+				}
+
+				streamID := ""
+				if idTags := entry.SearchTags("M3UPROXYID"); len(idTags) > 0 {
+					streamID = sanitizeStreamID(idTags[0].Value)
+				}
+				if streamID == "" {
+					streamID = sanitizeStreamID(tvgId)
+				}
+				if streamID == "" {
+					streamID = sanitizeStreamID(entry.Title)
+				}
+				streamID = uniqueStreamID(streamID, ids)
+				ids[streamID] = true
+
 				// Clear non-standard tags
 				entry.ClearTags()
 
 				stream := streamStruct{
 					index:            i,
+					id:               streamID,
 					m3u:              entry,
 					active:           false,
 					headers:          headers,
 					httpProxy:        proxy,
+					proxyPool:        proxyPool,
 					forceKodiHeaders: forceKodiHeaders,
 					radio:            radio == "true",
 					mux:              &sync.Mutex{},
-					transport:        transport,
 					disableRemap:     disableRemap,
+					provider:         provider,
 				}
 
 				streamList = append(streamList, &stream)
@@ -176,13 +215,50 @@ func LoadStreams() error {
 	wg.Wait()
 	log.Printf("Loaded %d active streams\n", len(streamList))
 
+	streamMap := make(map[string]*streamStruct)
+	for _, stream := range streamList {
+		streamMap[stream.id] = stream
+	}
+
 	streamsMutex.Lock()
 	defer streamsMutex.Unlock()
 	streams = streamList
+	streamsByID = streamMap
+	loadLegacyIndex(streamList)
 
 	return nil
 }
 
+// sanitizeStreamID keeps only the characters that are safe in a URL path
+// segment.
+func sanitizeStreamID(id string) string {
+	var b strings.Builder
+	for _, r := range strings.TrimSpace(id) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			b.WriteRune(r)
+		case r == ' ':
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+func uniqueStreamID(id string, ids map[string]bool) string {
+	if id == "" {
+		id = "stream"
+	}
+	if !ids[id] {
+		return id
+	}
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%s-%d", id, n)
+		if !ids[candidate] {
+			return candidate
+		}
+	}
+}
+
 func Run(configPath string) {
 
 	if err := LoadServerConfig(configPath); err != nil {
@@ -190,106 +266,130 @@ func Run(configPath string) {
 		return
 	}
 
-	setupLogging(Config.LogFile)
+	setupLogging(currentConfig().LogFile)
 
-	for {
-		log.Printf("Starting M3U Proxy Server\n")
+	log.Printf("Starting M3U Proxy Server\n")
 
-		log.Printf("Starting stream server\n")
-		log.Printf("Playlist: %s\n", Config.Playlist)
-		log.Printf("EPG: %s\n", Config.Epg)
+	log.Printf("Starting stream server\n")
+	log.Printf("Playlist: %s\n", currentConfig().Playlist)
+	log.Printf("EPG: %s\n", currentConfig().Epg)
 
-		err := auth.InitializeAuth(Config.Auth)
-		if err != nil {
-			log.Printf("Failed to initialize authentication: %s\n", err)
-			return
-		}
+	err := auth.InitializeAuth(currentConfig().Auth)
+	if err != nil {
+		log.Printf("Failed to initialize authentication: %s\n", err)
+		return
+	}
 
-		updateTimer = time.NewTimer(time.Duration(Config.ScanTime) * time.Second)
-		running = true
-		go func() {
-			LoadStreams()
-			for {
-				select {
-				case <-stopStreamLoading:
-					log.Println("Stopping stream server")
-					return
-				case <-updateTimer.C:
-					LoadStreams()
-					if running {
-						updateTimer.Reset(time.Duration(Config.ScanTime) * time.Second)
-					}
-				}
-				if !running {
-					break
+	if err := configureProxyPools(); err != nil {
+		log.Printf("Failed to configure proxy pools: %s\n", err)
+		return
+	}
+
+	updateTimer = time.NewTimer(time.Duration(currentConfig().ScanTime) * time.Second)
+	running = true
+	go func() {
+		LoadStreams()
+		for {
+			select {
+			case <-stopStreamLoading:
+				log.Println("Stopping stream server")
+				return
+			case <-updateTimer.C:
+				LoadStreams()
+				if running {
+					updateTimer.Reset(time.Duration(currentConfig().ScanTime) * time.Second)
 				}
 			}
-		}()
-
-		r := mux.NewRouter()
-		registerHealthCheckRoutes(r)
-		registerAPIRoutes(r)
-		registerPlaylistRoutes(r)
-		registerPlayerRoutes(r)
-		registerEpgRoutes(r)
-		registerStreamsRoutes(r)
-
-		if configureSecurity() != nil {
-			log.Println("GeoIP database not found, geo-location will not be available.")
+			if !running {
+				break
+			}
 		}
+	}()
 
-		server := &http.Server{
-			Addr:    fmt.Sprintf(":%d", Config.Port),
-			Handler: secure(r),
-		}
+	r := mux.NewRouter()
+	registerHealthCheckRoutes(r)
+	registerAPIRoutes(r)
+	registerPlaylistRoutes(r)
+	registerPlayerRoutes(r)
+	registerEpgRoutes(r)
+	registerHDHomeRunRoutes(r)
+	registerStreamsRoutes(r)
 
-		// Channel to listen for termination signal (SIGINT, SIGTERM)
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	configureCache()
 
-		go func() {
-			log.Printf("Server listening on %s.\n", server.Addr)
-			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				log.Println("Server failed:", err)
-			}
-		}()
+	if err := configureRemap(); err != nil {
+		log.Printf("Failed to configure remap: %s\n", err)
+		return
+	}
+
+	if err := configureEntitlements(); err != nil {
+		log.Printf("Failed to configure channel packages: %s\n", err)
+		return
+	}
+
+	if err := configureHDHomeRun(); err != nil {
+		log.Printf("Failed to configure HDHomeRun emulation: %s\n", err)
+		return
+	}
 
-		quitServer := false
+	if configureSecurity() != nil {
+		log.Println("GeoIP database not found, geo-location will not be available.")
+	}
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", currentConfig().Port),
+		Handler: secure(r),
+	}
+
+	// Channel to listen for termination signal (SIGINT, SIGTERM)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	// SIGHUP reloads the configuration in place
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	watcher := newFileWatcher()
+	go watcher.run()
+
+	go func() {
+		log.Printf("Server listening on %s.\n", server.Addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Println("Server failed:", err)
+		}
+	}()
+
+wait:
+	for {
 		select {
+		case <-hupChan:
+			log.Println("SIGHUP received, reloading configuration...")
+			Reload()
 		case <-sigChan:
 			log.Println("Signal received, shutting down server...")
-			quitServer = true
-		case <-restartServer:
-			quitServer = false
+			break wait
 		}
+	}
 
-		updateTimer.Stop()
-		running = false
-		stopStreamLoading <- true
-		log.Printf("Stream server stopped\n")
-
-		cleanGeoIp()
+	watcher.close()
+	signal.Stop(hupChan)
+	signal.Stop(sigChan)
+	updateTimer.Stop()
+	running = false
+	stopStreamLoading <- true
+	log.Printf("Stream server stopped\n")
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
+	cleanGeoIp()
+	stopProxyPools()
 
-		if err := server.Shutdown(ctx); err != nil {
-			log.Println("Server forced to shutdown:", err)
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-		if quitServer {
-			log.Println("Server shutdown.")
-			break
-		}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Server forced to shutdown:", err)
 	}
-}
 
-func Restart() {
-	go func() {
-		log.Println("Server restart in 3 seconds")
-		time.Sleep(3 * time.Second)
-		restartServer <- true
-	}()
+	log.Println("Server shutdown.")
 }
 
 func healthCheckRequest(w http.ResponseWriter, r *http.Request) {
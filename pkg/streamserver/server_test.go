@@ -0,0 +1,67 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package streamserver
+
+import "testing"
+
+func TestSanitizeStreamID(t *testing.T) {
+	tests := []struct {
+		id       string
+		expected string
+	}{
+		{"rtp1.pt", "rtp1.pt"},
+		{"  Sport TV 1 ", "Sport_TV_1"},
+		{"../../etc/passwd", "....etcpasswd"},
+		{"news/world?hd=1#live", "newsworldhd1live"},
+		{"SIC Notícias", "SIC_Notcias"},
+		{"canal-plus_2", "canal-plus_2"},
+		{"%2F%00", "2F00"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if got := sanitizeStreamID(test.id); got != test.expected {
+			t.Errorf("Unexpected id for '%s'. Expected: '%s', Got: '%s'", test.id, test.expected, got)
+		}
+	}
+}
+
+func TestUniqueStreamID(t *testing.T) {
+	ids := map[string]bool{"rtp1.pt": true, "news": true, "news-2": true, "stream": true}
+
+	tests := []struct {
+		id       string
+		expected string
+	}{
+		{"rtp2.pt", "rtp2.pt"},
+		{"rtp1.pt", "rtp1.pt-2"},
+		{"news", "news-3"},
+		{"", "stream-2"},
+	}
+
+	for _, test := range tests {
+		if got := uniqueStreamID(test.id, ids); got != test.expected {
+			t.Errorf("Unexpected id for '%s'. Expected: '%s', Got: '%s'", test.id, test.expected, got)
+		}
+	}
+}
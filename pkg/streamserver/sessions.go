@@ -0,0 +1,455 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package streamserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/a13labs/m3uproxy/pkg/auth"
+	"github.com/gorilla/mux"
+)
+
+const defaultSessionTimeout = 30
+
+// bitrateWindow is the period over which the bitrate of a session is
+// measured.
+const bitrateWindow = 5 * time.Second
+
+var errSessionEvicted = errors.New("session evicted by a concurrent stream limit")
+
+// viewerSession is a client watching a stream. HLS players send a request
+// for every playlist reload and segment, so a session lasts as long as its
+// client keeps requesting the stream within the session timeout.
+type viewerSession struct {
+	id        string
+	key       string
+	token     string
+	user      string
+	role      string
+	stream    *streamStruct
+	host      string
+	clientIP  string
+	userAgent string
+	started   time.Time
+	lastSeen  time.Time
+	// requests are the requests being served, by sequence number.
+	requests    map[int]context.CancelFunc
+	nextRequest int
+
+	// streamBucket shapes the session when its stream has a bandwidth
+	// limit, rateLimit is the lowest limit applied.
+	streamBucket *tokenBucket
+	rateLimit    int64
+
+	statsMutex  sync.Mutex
+	bytes       int64
+	bitrate     int64
+	windowStart time.Time
+	windowBytes int64
+}
+
+// sessionStatus is the view of a session given by the sessions API.
+type sessionStatus struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	Stream    string    `json:"stream"`
+	Provider  string    `json:"provider,omitempty"`
+	Host      string    `json:"host"`
+	ClientIP  string    `json:"client_ip"`
+	UserAgent string    `json:"user_agent"`
+	Started   time.Time `json:"started"`
+	LastSeen  time.Time `json:"last_seen"`
+	Bytes     int64     `json:"bytes"`
+	// Bitrate is the rate, in bits per second, the client was served at
+	// over the last few seconds, RateLimit the rate it is shaped to.
+	Bitrate   int64 `json:"bitrate"`
+	RateLimit int64 `json:"rate_limit,omitempty"`
+}
+
+// sessionWriter counts the bytes served to a session, and shapes them to
+// its bandwidth limits.
+type sessionWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	session *viewerSession
+	buckets []*tokenBucket
+}
+
+func (w *sessionWriter) Write(p []byte) (int, error) {
+
+	if len(w.buckets) == 0 {
+		n, err := w.ResponseWriter.Write(p)
+		w.session.served(n)
+		return n, err
+	}
+
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(written+shapingChunk, len(p))]
+		if err := shape(w.ctx, w.buckets, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		w.session.served(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (w *sessionWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *sessionWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (s *viewerSession) served(n int) {
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+
+	now := time.Now()
+	s.bytes += int64(n)
+	s.windowBytes += int64(n)
+	if elapsed := now.Sub(s.windowStart); elapsed >= bitrateWindow {
+		s.bitrate = s.windowBytes * 8 * int64(time.Second) / int64(elapsed)
+		s.windowStart = now
+		s.windowBytes = 0
+	}
+}
+
+func (s *viewerSession) status() sessionStatus {
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+
+	bitrate := s.bitrate
+	if time.Since(s.windowStart) >= 2*bitrateWindow {
+		// Nothing was served for a whole window
+		bitrate = 0
+	}
+	return sessionStatus{
+		ID:        s.id,
+		User:      s.user,
+		Stream:    s.stream.id,
+		Provider:  s.stream.provider,
+		Host:      s.host,
+		ClientIP:  s.clientIP,
+		UserAgent: s.userAgent,
+		Started:   s.started,
+		LastSeen:  s.lastSeen,
+		Bytes:     s.bytes,
+		Bitrate:   bitrate,
+		RateLimit: s.rateLimit,
+	}
+}
+
+// limitError is returned when a concurrent stream limit refuses a session.
+type limitError struct {
+	limit string
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("concurrent stream limit reached for %s", e.limit)
+}
+
+var (
+	sessions = make(map[string]*viewerSession)
+	// evictedSessions refuses the clients of evicted sessions, until the
+	// session timeout, so they do not evict the session replacing them.
+	evictedSessions = make(map[string]time.Time)
+	sessionsMutex   sync.Mutex
+)
+
+func sessionTimeout() time.Duration {
+	if currentConfig().Limits.SessionTimeout > 0 {
+		return time.Duration(currentConfig().Limits.SessionTimeout) * time.Second
+	}
+	return defaultSessionTimeout * time.Second
+}
+
+func newSessionID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func upstreamHost(stream *streamStruct) string {
+	stream.mux.Lock()
+	uri := stream.m3u.URI
+	stream.mux.Unlock()
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// openSession tracks a request made with token, empty for clients without
+// users, on stream. It returns the response writer and the request to
+// serve, cancelled if the session is closed, and the function to call once
+// the request is served.
+func openSession(w http.ResponseWriter, r *http.Request, stream *streamStruct, token string) (http.ResponseWriter, *http.Request, func(), error) {
+
+	var user, role string
+	if token != "" {
+		user, _ = auth.GetUserFromToken(token)
+		role, _ = auth.GetRoleFromToken(token)
+	}
+
+	now := time.Now()
+	ip := clientIP(r)
+	key := user + "\x00" + ip + "\x00" + stream.id
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	expireSessions(now)
+
+	if _, ok := evictedSessions[key]; ok {
+		return nil, nil, nil, errSessionEvicted
+	}
+
+	s, ok := sessions[key]
+	if !ok {
+		s = &viewerSession{
+			id:          newSessionID(),
+			key:         key,
+			token:       token,
+			user:        user,
+			role:        role,
+			stream:      stream,
+			host:        upstreamHost(stream),
+			clientIP:    ip,
+			userAgent:   r.UserAgent(),
+			started:     now,
+			requests:    make(map[int]context.CancelFunc),
+			windowStart: now,
+		}
+		if err := admitSession(s, now); err != nil {
+			return nil, nil, nil, err
+		}
+		sessions[key] = s
+		log.Printf("Session %s started: user '%s' watching %s from %s\n", s.id, user, stream.id, ip)
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	id := s.nextRequest
+	s.nextRequest++
+	s.requests[id] = cancel
+	s.lastSeen = now
+
+	done := func() {
+		sessionsMutex.Lock()
+		delete(s.requests, id)
+		s.lastSeen = time.Now()
+		sessionsMutex.Unlock()
+		cancel()
+	}
+	buckets := sessionBuckets(s)
+	s.rateLimit = rateLimit(buckets)
+
+	writer := &sessionWriter{ResponseWriter: w, ctx: ctx, session: s, buckets: buckets}
+	return writer, r.WithContext(ctx), done, nil
+}
+
+// expireSessions drops the sessions without requests for longer than the
+// session timeout. Must be called with sessionsMutex held.
+func expireSessions(now time.Time) {
+	timeout := sessionTimeout()
+	for key, s := range sessions {
+		if len(s.requests) == 0 && now.Sub(s.lastSeen) > timeout {
+			delete(sessions, key)
+			log.Printf("Session %s ended: user '%s' stopped watching %s\n", s.id, s.user, s.stream.id)
+		}
+	}
+	for key, until := range evictedSessions {
+		if now.After(until) {
+			delete(evictedSessions, key)
+		}
+	}
+}
+
+// admitSession checks a new session against the concurrent stream limits.
+// An idle session of the same user and client on another stream is closed
+// first, as the client switched channels, then the oldest ones if the
+// policy allows it. Both are kept out until the session timeout, so two
+// players sharing an address can not take turns beyond the limit. Must be
+// called with sessionsMutex held.
+func admitSession(s *viewerSession, now time.Time) error {
+
+	type limit struct {
+		name  string
+		max   int
+		match func(*viewerSession) bool
+	}
+
+	limits := make([]limit, 0, 3)
+	if s.user != "" && currentConfig().Limits.MaxStreamsPerUser > 0 {
+		limits = append(limits, limit{"user " + s.user, currentConfig().Limits.MaxStreamsPerUser, func(o *viewerSession) bool {
+			return o.user == s.user
+		}})
+	}
+	if max := currentConfig().Limits.Providers[s.stream.provider]; s.stream.provider != "" && max > 0 {
+		limits = append(limits, limit{"provider " + s.stream.provider, max, func(o *viewerSession) bool {
+			return o.stream.provider == s.stream.provider
+		}})
+	}
+	if max := currentConfig().Limits.Hosts[s.host]; s.host != "" && max > 0 {
+		limits = append(limits, limit{"host " + s.host, max, func(o *viewerSession) bool {
+			return o.host == s.host
+		}})
+	}
+
+	for _, l := range limits {
+		for {
+			var count int
+			var switched, oldest *viewerSession
+			for _, o := range sessions {
+				if !l.match(o) {
+					continue
+				}
+				count++
+				if s.user != "" && o.user == s.user && o.clientIP == s.clientIP && len(o.requests) == 0 && (switched == nil || o.started.Before(switched.started)) {
+					switched = o
+				}
+				if oldest == nil || o.started.Before(oldest.started) {
+					oldest = o
+				}
+			}
+			if count < l.max {
+				break
+			}
+
+			switch {
+			case switched != nil:
+				closeSession(switched)
+				evictedSessions[switched.key] = now.Add(sessionTimeout())
+				log.Printf("Session %s replaced by %s within the limit of the %s\n", switched.id, s.stream.id, l.name)
+			case currentConfig().Limits.Policy == LimitPolicyEvictOldest:
+				closeSession(oldest)
+				evictedSessions[oldest.key] = now.Add(sessionTimeout())
+				log.Printf("Session %s evicted by the limit of the %s\n", oldest.id, l.name)
+			default:
+				log.Printf("Session of user '%s' on %s refused by the limit of the %s\n", s.user, s.stream.id, l.name)
+				return &limitError{limit: l.name}
+			}
+		}
+	}
+	return nil
+}
+
+// closeSession ends a session, aborting the requests being served. Must be
+// called with sessionsMutex held.
+func closeSession(s *viewerSession) {
+	delete(sessions, s.key)
+	for _, cancel := range s.requests {
+		cancel()
+	}
+	log.Printf("Session %s closed: user '%s' watching %s\n", s.id, s.user, s.stream.id)
+}
+
+// writeSessionError answers a request refused by openSession.
+func writeSessionError(w http.ResponseWriter, err error) {
+	var limit *limitError
+	if errors.As(err, &limit) {
+		http.Error(w, fmt.Sprintf("Too many streams: %s", err), http.StatusTooManyRequests)
+		return
+	}
+	http.Error(w, "Session ended: "+err.Error(), http.StatusConflict)
+}
+
+func sessionsAPIRequest(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case http.MethodGet:
+		sessionsMutex.Lock()
+		expireSessions(time.Now())
+		list := make([]sessionStatus, 0, len(sessions))
+		for _, s := range sessions {
+			list = append(list, s.status())
+		}
+		sessionsMutex.Unlock()
+
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Started.Before(list[j].Started)
+		})
+		writeJSON(w, list)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// sessionAPIRequest terminates a session, which is kept out until the
+// session timeout. Its whole token is revoked too, refusing any further
+// request made with it, so the client can not start again without
+// authenticating.
+func sessionAPIRequest(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case http.MethodDelete:
+		id := mux.Vars(r)["id"]
+
+		sessionsMutex.Lock()
+		var session *viewerSession
+		for _, s := range sessions {
+			if s.id == id {
+				session = s
+				break
+			}
+		}
+		if session != nil {
+			closeSession(session)
+			evictedSessions[session.key] = time.Now().Add(sessionTimeout())
+		}
+		sessionsMutex.Unlock()
+
+		if session == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if session.token != "" {
+			if err := auth.RevokeToken(session.token); err != nil {
+				log.Printf("Failed to revoke the token of session %s: %s\n", id, err)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package streamserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestSession(user, ip, streamID, provider string, started time.Time, busy bool) *viewerSession {
+	s := &viewerSession{
+		id:       user + "@" + ip + "/" + streamID,
+		key:      user + "\x00" + ip + "\x00" + streamID,
+		user:     user,
+		stream:   &streamStruct{id: streamID, provider: provider, mux: &sync.Mutex{}},
+		clientIP: ip,
+		started:  started,
+		lastSeen: started,
+		requests: make(map[int]context.CancelFunc),
+	}
+	if busy {
+		s.requests[0] = func() {}
+	}
+	return s
+}
+
+func TestAdmitSession(t *testing.T) {
+	now := time.Now()
+	earlier := now.Add(-time.Minute)
+
+	tests := []struct {
+		name     string
+		limits   LimitsConfig
+		existing []*viewerSession
+		session  *viewerSession
+		refused  bool
+		closed   []string
+	}{
+		{
+			name:     "under the user limit",
+			limits:   LimitsConfig{MaxStreamsPerUser: 2},
+			existing: []*viewerSession{newTestSession("alice", "10.0.0.1", "one", "", earlier, true)},
+			session:  newTestSession("alice", "10.0.0.2", "two", "", now, false),
+		},
+		{
+			name:     "user limit refused",
+			limits:   LimitsConfig{MaxStreamsPerUser: 1},
+			existing: []*viewerSession{newTestSession("alice", "10.0.0.1", "one", "", earlier, true)},
+			session:  newTestSession("alice", "10.0.0.2", "two", "", now, false),
+			refused:  true,
+		},
+		{
+			name:     "idle session replaced on channel switch",
+			limits:   LimitsConfig{MaxStreamsPerUser: 1},
+			existing: []*viewerSession{newTestSession("alice", "10.0.0.1", "one", "", earlier, false)},
+			session:  newTestSession("alice", "10.0.0.1", "two", "", now, false),
+			closed:   []string{"alice@10.0.0.1/one"},
+		},
+		{
+			name:     "busy session on the same address refused",
+			limits:   LimitsConfig{MaxStreamsPerUser: 1},
+			existing: []*viewerSession{newTestSession("alice", "10.0.0.1", "one", "", earlier, true)},
+			session:  newTestSession("alice", "10.0.0.1", "two", "", now, false),
+			refused:  true,
+		},
+		{
+			name:   "oldest session evicted",
+			limits: LimitsConfig{MaxStreamsPerUser: 2, Policy: LimitPolicyEvictOldest},
+			existing: []*viewerSession{
+				newTestSession("alice", "10.0.0.1", "one", "", earlier, true),
+				newTestSession("alice", "10.0.0.2", "two", "", earlier.Add(time.Second), true),
+			},
+			session: newTestSession("alice", "10.0.0.3", "three", "", now, false),
+			closed:  []string{"alice@10.0.0.1/one"},
+		},
+		{
+			name:     "provider limit shared between users",
+			limits:   LimitsConfig{Providers: map[string]int{"iptv": 1}},
+			existing: []*viewerSession{newTestSession("alice", "10.0.0.1", "one", "iptv", earlier, true)},
+			session:  newTestSession("bob", "10.0.0.2", "two", "iptv", now, false),
+			refused:  true,
+		},
+		{
+			name:     "provider limit ignores other providers",
+			limits:   LimitsConfig{Providers: map[string]int{"iptv": 1}},
+			existing: []*viewerSession{newTestSession("alice", "10.0.0.1", "one", "other", earlier, true)},
+			session:  newTestSession("bob", "10.0.0.2", "two", "iptv", now, false),
+		},
+		{
+			name:     "no user limit without users",
+			limits:   LimitsConfig{MaxStreamsPerUser: 1},
+			existing: []*viewerSession{newTestSession("", "10.0.0.1", "one", "", earlier, true)},
+			session:  newTestSession("", "10.0.0.1", "two", "", now, false),
+		},
+	}
+
+	for _, test := range tests {
+		Config = &ServerConfig{Limits: test.limits}
+		sessions = make(map[string]*viewerSession)
+		evictedSessions = make(map[string]time.Time)
+		for _, s := range test.existing {
+			sessions[s.key] = s
+		}
+
+		err := admitSession(test.session, now)
+		var limit *limitError
+		if test.refused != errors.As(err, &limit) {
+			t.Errorf("%s: unexpected result: %v", test.name, err)
+		}
+
+		closed := make(map[string]bool)
+		for _, s := range test.existing {
+			if _, ok := sessions[s.key]; !ok {
+				closed[s.id] = true
+				if _, ok := evictedSessions[s.key]; !ok {
+					t.Errorf("%s: session %s closed but not kept out", test.name, s.id)
+				}
+			}
+		}
+		if len(closed) != len(test.closed) {
+			t.Errorf("%s: unexpected sessions closed. Expected: %v, Got: %v", test.name, test.closed, closed)
+		}
+		for _, id := range test.closed {
+			if !closed[id] {
+				t.Errorf("%s: session %s should have been closed", test.name, id)
+			}
+		}
+	}
+}
+
+func TestOpenSessionEvicted(t *testing.T) {
+	Config = &ServerConfig{}
+	sessions = make(map[string]*viewerSession)
+	evictedSessions = make(map[string]time.Time)
+
+	stream := &streamStruct{id: "one", mux: &sync.Mutex{}}
+	r := httptest.NewRequest(http.MethodGet, "/token/one/master.m3u8", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+
+	_, _, done, err := openSession(httptest.NewRecorder(), r, stream, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	done()
+
+	evictedSessions["\x0010.0.0.1\x00one"] = time.Now().Add(time.Minute)
+	delete(sessions, "\x0010.0.0.1\x00one")
+
+	w := httptest.NewRecorder()
+	if _, _, _, err := openSession(w, r, stream, ""); !errors.Is(err, errSessionEvicted) {
+		t.Fatalf("Expected evicted session, got: %v", err)
+	}
+	writeSessionError(w, errSessionEvicted)
+	if w.Code != http.StatusConflict {
+		t.Errorf("Unexpected status. Expected: 409, Got: %d", w.Code)
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package streamserver
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// shapingChunk is the largest write made at once by a shaped response, so
+// the viewers sharing a bucket take turns.
+const shapingChunk = 16 * 1024
+
+// tokenBucket limits a rate in bytes per second. Tokens are reserved
+// ahead, the bucket going into debt, so the callers are served in the order
+// they asked.
+type tokenBucket struct {
+	limit  BandwidthLimit
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+func newTokenBucket(limit BandwidthLimit) *tokenBucket {
+	rate := float64(limit.Rate) * 1000 / 8
+	burst := float64(limit.Burst) * 1000
+	if burst <= 0 {
+		burst = rate
+	}
+	return &tokenBucket{
+		limit:  limit,
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n bytes and returns how long to wait before sending them.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+var (
+	globalBucket *tokenBucket
+	userBuckets  = make(map[string]*tokenBucket)
+	// roleBuckets are the buckets of the users limited by their role, by
+	// user, as each user of the role gets the role limit.
+	roleBuckets  = make(map[string]*tokenBucket)
+	bucketsMutex sync.Mutex
+)
+
+// sharedBucket returns the bucket kept in *bucket for limit, replaced when
+// the limit changed. Must be called with bucketsMutex held.
+func sharedBucket(bucket **tokenBucket, limit BandwidthLimit) *tokenBucket {
+	if limit.Rate <= 0 {
+		*bucket = nil
+		return nil
+	}
+	if *bucket == nil || (*bucket).limit != limit {
+		*bucket = newTokenBucket(limit)
+	}
+	return *bucket
+}
+
+// sessionBuckets returns the buckets limiting a session: its stream limit,
+// the limit of its user, or else of its role, and the global limit.
+func sessionBuckets(s *viewerSession) []*tokenBucket {
+
+	config := currentConfig().Bandwidth
+	buckets := make([]*tokenBucket, 0, 3)
+
+	if limit, ok := config.Streams[s.stream.id]; ok && limit.Rate > 0 {
+		if s.streamBucket == nil || s.streamBucket.limit != limit {
+			s.streamBucket = newTokenBucket(limit)
+		}
+		buckets = append(buckets, s.streamBucket)
+	}
+
+	bucketsMutex.Lock()
+	defer bucketsMutex.Unlock()
+
+	if s.user != "" {
+		if limit, ok := config.Users[s.user]; ok {
+			bucket := userBuckets[s.user]
+			if b := sharedBucket(&bucket, limit); b != nil {
+				userBuckets[s.user] = b
+				buckets = append(buckets, b)
+			}
+		} else if limit, ok := config.Roles[s.role]; ok {
+			bucket := roleBuckets[s.user]
+			if b := sharedBucket(&bucket, limit); b != nil {
+				roleBuckets[s.user] = b
+				buckets = append(buckets, b)
+			}
+		}
+	}
+
+	if b := sharedBucket(&globalBucket, config.Global); b != nil {
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// rateLimit is the lowest rate, in bits per second, of buckets.
+func rateLimit(buckets []*tokenBucket) int64 {
+	var limit int64
+	for _, b := range buckets {
+		rate := int64(b.rate * 8)
+		if limit == 0 || rate < limit {
+			limit = rate
+		}
+	}
+	return limit
+}
+
+// shape waits until n bytes may be sent through buckets.
+func shape(ctx context.Context, buckets []*tokenBucket, n int) error {
+	var wait time.Duration
+	for _, b := range buckets {
+		if d := b.reserve(n); d > wait {
+			wait = d
+		}
+	}
+	if wait == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package streamserver
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    BandwidthLimit
+		reserves []int
+		expected time.Duration
+	}{
+		// 8 kbit/s is 1000 bytes per second
+		{"within the default burst", BandwidthLimit{Rate: 8}, []int{500, 500}, 0},
+		{"over the default burst", BandwidthLimit{Rate: 8}, []int{500, 500, 500}, 500 * time.Millisecond},
+		{"within a larger burst", BandwidthLimit{Rate: 8, Burst: 4}, []int{2000, 2000}, 0},
+		{"debt accumulated", BandwidthLimit{Rate: 8, Burst: 4}, []int{4000, 1000, 1000}, 2 * time.Second},
+	}
+
+	for _, test := range tests {
+		b := newTokenBucket(test.limit)
+		var wait time.Duration
+		for _, n := range test.reserves {
+			wait = b.reserve(n)
+		}
+		if wait < test.expected-10*time.Millisecond || wait > test.expected {
+			t.Errorf("%s: unexpected wait. Expected: %s, Got: %s", test.name, test.expected, wait)
+		}
+	}
+}
+
+func TestSessionBuckets(t *testing.T) {
+	Config = &ServerConfig{Bandwidth: BandwidthConfig{
+		Users:   map[string]BandwidthLimit{"alice": {Rate: 8000}},
+		Roles:   map[string]BandwidthLimit{"viewer": {Rate: 4000}},
+		Streams: map[string]BandwidthLimit{"uhd": {Rate: 16000}},
+	}}
+	globalBucket = nil
+	userBuckets = make(map[string]*tokenBucket)
+	roleBuckets = make(map[string]*tokenBucket)
+
+	session := func(user, role, streamID string) *viewerSession {
+		return &viewerSession{user: user, role: role, stream: &streamStruct{id: streamID, mux: &sync.Mutex{}}}
+	}
+
+	tests := []struct {
+		name   string
+		a, b   *viewerSession
+		shared bool
+	}{
+		{"user limit shared by the sessions of the user", session("alice", "viewer", "one"), session("alice", "viewer", "two"), true},
+		{"role limit shared by the sessions of a user", session("bob", "viewer", "one"), session("bob", "viewer", "two"), true},
+		{"role limit applied to each user", session("bob", "viewer", "one"), session("carol", "viewer", "one"), false},
+		{"stream limit applied to each session", session("", "", "uhd"), session("", "", "uhd"), false},
+	}
+
+	for _, test := range tests {
+		a, b := sessionBuckets(test.a), sessionBuckets(test.b)
+		if len(a) != 1 || len(b) != 1 {
+			t.Errorf("%s: unexpected buckets. Expected: 1, Got: %d and %d", test.name, len(a), len(b))
+			continue
+		}
+		if shared := a[0] == b[0]; shared != test.shared {
+			t.Errorf("%s: unexpected sharing. Expected: %v, Got: %v", test.name, test.shared, shared)
+		}
+	}
+}
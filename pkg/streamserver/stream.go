@@ -22,11 +22,11 @@ THE SOFTWARE.
 package streamserver
 
 import (
-	"encoding/base64"
+	"fmt"
 	"log"
 	"net/http"
-	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/a13labs/m3uproxy/pkg/auth"
@@ -38,15 +38,17 @@ import (
 
 type streamStruct struct {
 	index            int
+	id               string
 	m3u              m3uparser.M3UEntry
 	active           bool
 	mux              *sync.Mutex
 	headers          map[string]string
 	httpProxy        string
+	proxyPool        string
 	forceKodiHeaders bool
 	radio            bool
-	transport        *http.Transport
 	disableRemap     bool
+	provider         string
 }
 
 var supportedMediaTypes = []contenttype.MediaType{
@@ -63,11 +65,39 @@ var supportedMediaTypes = []contenttype.MediaType{
 	contenttype.NewMediaType("video/mp2t"),
 	contenttype.NewMediaType("video/m2ts"),
 	contenttype.NewMediaType("video/mp4"),
+	contenttype.NewMediaType("video/iso.segment"),
+	contenttype.NewMediaType("application/mp4"),
+	contenttype.NewMediaType("application/octet-stream"),
 	contenttype.NewMediaType("binary/octet-stream"),
+	contenttype.NewMediaType("text/vtt"),
+}
+
+// route returns the client the requests of the stream go through, and the
+// proxy, or chain of proxies, it uses.
+func (stream *streamStruct) route() (*http.Client, string) {
+	if stream.proxyPool != "" {
+		proxy, ok := poolProxy(stream.proxyPool, stream.id)
+		if !ok {
+			return &http.Client{Transport: unknownPoolTransport{name: stream.proxyPool}}, "pool=" + stream.proxyPool
+		}
+		return upstreamClient(proxy), proxy
+	}
+	return upstreamClient(stream.httpProxy), stream.httpProxy
 }
 
 func (stream *streamStruct) healthCheck() {
-	resp, err := executeRequest("GET", stream.m3u.URI, stream.transport, stream.headers)
+
+	// A stream whose proxy pool is unknown, or whose proxy is invalid, stays
+	// offline, it must not be reached without its proxies
+	if (stream.proxyPool != "" && !proxyPoolConfigured(stream.proxyPool)) || !proxyValid(stream.httpProxy) {
+		stream.mux.Lock()
+		stream.active = false
+		stream.mux.Unlock()
+		return
+	}
+
+	client, proxy := stream.route()
+	resp, err := executeRequest("GET", stream.m3u.URI, client, proxy, stream.headers)
 	if err != nil {
 		return
 	}
@@ -79,7 +109,7 @@ func (stream *streamStruct) healthCheck() {
 	}
 	stream.mux.Unlock()
 
-	streamActive := verifyStream(stream.m3u.URI, stream.transport, stream.headers)
+	streamActive := verifyStream(stream.m3u.URI, client, proxy, stream.headers)
 
 	stream.mux.Lock()
 	stream.active = streamActive
@@ -92,37 +122,58 @@ func (stream *streamStruct) serve(w http.ResponseWriter, r *http.Request) {
 
 	cache := r.URL.Query().Get("cache")
 
-	var uri *url.URL
+	uri := stream.m3u.URI
 	if cache == "" {
+		if vars["path"] == "stream.ts" {
+			serveTransportStream(w, r, stream)
+			return
+		}
+		if strings.HasPrefix(vars["path"], packagedPrefix) {
+			servePackagedSegment(w, r, stream, vars["path"])
+			return
+		}
 		if vars["path"] != "master.m3u8" {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		uri, _ = url.Parse(stream.m3u.URI)
 	} else {
-
-		originalUrlBytes, err := base64.URLEncoding.DecodeString(cache)
-
+		// Only URIs issued by the proxy for this stream are fetched
+		var err error
+		uri, err = openRemap(stream.id, cache)
 		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
+			log.Printf("Refused remap for stream %s: %s\n", stream.id, err)
+			w.WriteHeader(http.StatusForbidden)
 			return
 		}
+	}
 
-		orig, err := url.Parse(string(originalUrlBytes))
-		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
+	// Low-Latency HLS blocking reloads are handled by the upstream server
+	uri = forwardDeliveryDirectives(uri, r.URL.Query())
 
-		uri = orig
+	serveAndRemap(w, r, stream, uri, cache == "")
+}
+
+// lookupStream returns the stream with the given id or, for index based
+// URLs used before stable ids, the id to redirect to.
+func lookupStream(streamID string) (*streamStruct, string) {
+
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+
+	if stream, ok := streamsByID[streamID]; ok {
+		return stream, ""
 	}
 
-	serveAndRemap(uri.String(), stream.transport, stream.headers, w)
+	index, err := strconv.Atoi(streamID)
+	if err != nil {
+		return nil, ""
+	}
+	return nil, legacyStreamID(index)
 }
 
 func streamRequest(w http.ResponseWriter, r *http.Request) {
 
-	if r.Method != http.MethodGet {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
@@ -137,26 +188,40 @@ func streamRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	streamID, err := strconv.Atoi(vars["streamId"])
-	if err != nil {
-		http.Error(w, "Invalid stream ID", http.StatusBadRequest)
+	stream, redirectID := lookupStream(vars["streamId"])
+	if redirectID != "" {
+		target := fmt.Sprintf("/%s/%s/%s", token, redirectID, vars["path"])
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusTemporaryRedirect)
 		return
 	}
 
-	streamsMutex.Lock()
-	defer streamsMutex.Unlock()
+	if stream == nil {
+		http.Error(w, "Stream not found", http.StatusNotFound)
+		return
+	}
 
-	if streamID < 0 || streamID >= len(streams) {
-		http.Error(w, "Invalid stream ID", http.StatusBadRequest)
+	if !getEntitlement(token).allows(stream) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		log.Printf("Access to stream %s outside the entitlement of the token.\n", stream.id)
 		return
 	}
 
-	stream := streams[streamID]
 	if !stream.active {
 		http.Error(w, "Stream not active", http.StatusNotFound)
 		return
 	}
-	stream.serve(w, r)
+
+	sw, sr, done, err := openSession(w, r, stream, token)
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	defer done()
+
+	stream.serve(sw, sr)
 }
 
 func registerStreamsRoutes(r *mux.Router) *mux.Router {
@@ -0,0 +1,113 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package streamserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+const defaultReadTimeout = 10
+
+// timeoutError reports an upstream server which stopped answering. It is a
+// net.Error, so it is answered with 504 Gateway Timeout.
+type timeoutError struct {
+	op string
+}
+
+func (e *timeoutError) Error() string {
+	return "upstream " + e.op + " timeout"
+}
+
+func (e *timeoutError) Timeout() bool {
+	return true
+}
+
+func (e *timeoutError) Temporary() bool {
+	return true
+}
+
+var (
+	errFirstByteTimeout = &timeoutError{op: "first byte"}
+	errReadTimeout      = &timeoutError{op: "read"}
+)
+
+func readTimeout() time.Duration {
+	if currentConfig().Upstream.ReadTimeout > 0 {
+		return time.Duration(currentConfig().Upstream.ReadTimeout) * time.Second
+	}
+	return defaultReadTimeout * time.Second
+}
+
+// timeoutCause returns the timeout which cancelled ctx, if any, in place of
+// err.
+func timeoutCause(ctx context.Context, err error) error {
+	var timeout *timeoutError
+	if cause := context.Cause(ctx); errors.As(cause, &timeout) {
+		return cause
+	}
+	return err
+}
+
+// idleBody is the body of an upstream response, which is aborted when no
+// data is received for the read timeout. Live streams are kept open for
+// as long as data keeps flowing.
+type idleBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	idle   time.Duration
+	timer  *time.Timer
+}
+
+func newIdleBody(ctx context.Context, body io.ReadCloser, cancel context.CancelCauseFunc, idle time.Duration) *idleBody {
+	b := &idleBody{
+		ReadCloser: body,
+		ctx:        ctx,
+		cancel:     cancel,
+		idle:       idle,
+	}
+	b.timer = time.AfterFunc(idle, func() {
+		cancel(errReadTimeout)
+	})
+	return b
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.idle)
+	}
+	if err != nil && err != io.EOF {
+		err = timeoutCause(b.ctx, err)
+	}
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+	return err
+}
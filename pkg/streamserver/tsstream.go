@@ -0,0 +1,505 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package streamserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/a13labs/m3uproxy/pkg/m3uparser"
+	"github.com/a13labs/m3uproxy/pkg/mpegts"
+)
+
+const (
+	// defaultLiveSegments starts live streams three segments from the end
+	// of the playlist, as HLS players do.
+	defaultLiveSegments = 3
+	// maxPlaylistFailures stops a stream when the upstream playlist can't
+	// be loaded that many times in a row.
+	maxPlaylistFailures = 3
+	// Adaptive switching goes down a variant after slowSegments segments
+	// downloaded in more than slowRatio of their duration, and up after
+	// fastSegments downloaded in less than fastRatio of their duration.
+	slowSegments = 2
+	slowRatio    = 0.8
+	fastSegments = 10
+	fastRatio    = 0.25
+)
+
+var errUnsupportedSegments = errors.New("segments can't be packaged in a transport stream")
+
+type tsVariant struct {
+	uri       string
+	bandwidth int
+}
+
+// tsStreamer writes the segments of a HLS stream as one transport stream.
+type tsStreamer struct {
+	stream        *streamStruct
+	variants      []tsVariant
+	current       int
+	mediaURI      string
+	nextSequence  int64
+	discontinuity bool
+	keys          map[string][]byte
+	slow          int
+	fast          int
+}
+
+// serveTransportStream serves a stream as one continuous MPEG-TS stream,
+// following the media playlist of HLS streams.
+func serveTransportStream(w http.ResponseWriter, r *http.Request, stream *streamStruct) {
+
+	ctx := r.Context()
+
+	client, proxy := stream.route()
+	resp, err := fetchShared(ctx, stream.m3u.URI, client, proxy, stream.headers, true)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+
+	if resp.broadcast != nil {
+		// The upstream stream is already continuous
+		w.Header().Set("Content-Type", resp.header.Get("Content-Type"))
+		serveBroadcast(w, r, resp.broadcast)
+		return
+	}
+
+	if !isPlaylistContentType(resp.header.Get("Content-Type")) {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	s := &tsStreamer{
+		stream:       stream,
+		mediaURI:     stream.m3u.URI,
+		nextSequence: -1,
+		keys:         make(map[string][]byte),
+	}
+
+	playlist, base, err := decodePlaylist(resp)
+	if err == nil && playlist.Type == "master" {
+		err = s.selectVariant(playlist, base)
+		if err == nil {
+			playlist, base, err = s.load(ctx)
+		}
+	}
+	if err == nil && hasTag(playlist, "EXT-X-MAP") {
+		// Fragmented MP4 segments
+		err = errUnsupportedSegments
+	}
+
+	switch {
+	case errors.Is(err, errUnsupportedSegments):
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	case err != nil:
+		writeUpstreamError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if err := s.run(ctx, w, playlist, base); err != nil && ctx.Err() == nil {
+		log.Printf("Transport stream of stream %s stopped: %s\n", stream.id, err)
+	}
+}
+
+func decodePlaylist(resp *sharedResponse) (*m3uparser.M3UPlaylist, *url.URL, error) {
+	playlist, err := m3uparser.DecodeFromReader(bytes.NewReader(resp.body))
+	if err != nil {
+		return nil, nil, err
+	}
+	return playlist, resp.finalURL, nil
+}
+
+// load fetches the media playlist being followed.
+func (s *tsStreamer) load(ctx context.Context) (*m3uparser.M3UPlaylist, *url.URL, error) {
+
+	client, proxy := s.stream.route()
+	resp, err := fetchShared(ctx, s.mediaURI, client, proxy, s.stream.headers, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !isPlaylistContentType(resp.header.Get("Content-Type")) {
+		return nil, nil, errUnsupportedSegments
+	}
+
+	playlist, base, err := decodePlaylist(resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	if playlist.Type != "media" {
+		return nil, nil, fmt.Errorf("%s is not a media playlist", s.mediaURI)
+	}
+	return playlist, base, nil
+}
+
+// selectVariant picks the variant of a master playlist to follow, by
+// increasing bandwidth.
+func (s *tsStreamer) selectVariant(playlist *m3uparser.M3UPlaylist, base *url.URL) error {
+
+	for _, entry := range playlist.Entries {
+		var bandwidth int
+		for _, tag := range entry.SearchTags("EXT-X-STREAM-INF") {
+			value, _ := tag.GetAttribute("BANDWIDTH")
+			bandwidth, _ = strconv.Atoi(value)
+		}
+
+		uri, err := url.Parse(entry.URI)
+		if err != nil {
+			continue
+		}
+		s.variants = append(s.variants, tsVariant{
+			uri:       base.ResolveReference(uri).String(),
+			bandwidth: bandwidth,
+		})
+	}
+
+	if len(s.variants) == 0 {
+		return errors.New("master playlist without variants")
+	}
+
+	sort.SliceStable(s.variants, func(i, j int) bool {
+		return s.variants[i].bandwidth < s.variants[j].bandwidth
+	})
+
+	s.current = s.maxVariant()
+	if currentConfig().TSStream.Variant == "lowest" {
+		s.current = 0
+	}
+	s.mediaURI = s.variants[s.current].uri
+	return nil
+}
+
+// maxVariant is the highest variant allowed by the configured bandwidth.
+func (s *tsStreamer) maxVariant() int {
+	max := len(s.variants) - 1
+	if currentConfig().TSStream.MaxBandwidth > 0 {
+		for max > 0 && s.variants[max].bandwidth > currentConfig().TSStream.MaxBandwidth {
+			max--
+		}
+	}
+	return max
+}
+
+func (s *tsStreamer) run(ctx context.Context, w io.Writer, playlist *m3uparser.M3UPlaylist, base *url.URL) error {
+
+	flusher, _ := w.(http.Flusher)
+	failures := 0
+
+	for {
+		written, err := s.writeSegments(ctx, w, flusher, playlist, base)
+		if err != nil {
+			return err
+		}
+
+		if playlist.Trailer.Exist("EXT-X-ENDLIST") || playlist.Tags.Exist("EXT-X-ENDLIST") {
+			return nil
+		}
+
+		if written == 0 {
+			targetDuration, _ := strconv.Atoi(playlist.Tags.GetValue("EXT-X-TARGETDURATION"))
+			if targetDuration <= 0 {
+				targetDuration = 2
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(targetDuration) * time.Second / 2):
+			}
+		}
+
+		next, nextBase, err := s.load(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			failures++
+			if failures >= maxPlaylistFailures {
+				return err
+			}
+			log.Printf("Error reloading playlist of stream %s: %s\n", s.stream.id, err)
+			continue
+		}
+		failures = 0
+		playlist, base = next, nextBase
+	}
+}
+
+// writeSegments writes the segments of the playlist not written yet, in
+// media sequence order. It stops early when switching variants.
+func (s *tsStreamer) writeSegments(ctx context.Context, w io.Writer, flusher http.Flusher, playlist *m3uparser.M3UPlaylist, base *url.URL) (int, error) {
+
+	sequence, _ := strconv.ParseInt(playlist.Tags.GetValue("EXT-X-MEDIA-SEQUENCE"), 10, 64)
+	ended := playlist.Trailer.Exist("EXT-X-ENDLIST") || playlist.Tags.Exist("EXT-X-ENDLIST")
+
+	if s.nextSequence < 0 {
+		start := 0
+		if !ended {
+			live := currentConfig().TSStream.LiveSegments
+			if live <= 0 {
+				live = defaultLiveSegments
+			}
+			start = max(0, len(playlist.Entries)-live)
+		}
+		s.nextSequence = sequence + int64(start)
+	}
+
+	if s.nextSequence < sequence {
+		log.Printf("Transport stream of stream %s fell behind, skipping %d segments\n", s.stream.id, sequence-s.nextSequence)
+		s.nextSequence = sequence
+		s.discontinuity = true
+	}
+
+	// The tags before the first segment apply to it
+	key := lastTag(playlist.Tags, "EXT-X-KEY")
+	discontinuity := playlist.Tags.Exist("EXT-X-DISCONTINUITY")
+
+	written := 0
+	for i, entry := range playlist.Entries {
+
+		if tag := lastTag(entry.Tags, "EXT-X-KEY"); tag != nil {
+			key = tag
+		}
+		discontinuity = discontinuity || entry.Tags.Exist("EXT-X-DISCONTINUITY")
+
+		entrySequence := sequence + int64(i)
+		if entrySequence < s.nextSequence {
+			discontinuity = false
+			continue
+		}
+
+		start := time.Now()
+		data, err := s.segment(ctx, entry.URI, base, key, entrySequence)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, errUnsupportedSegments) {
+				return written, err
+			}
+			log.Printf("Skipping segment %d of stream %s: %s\n", entrySequence, s.stream.id, err)
+			s.discontinuity = true
+			s.nextSequence = entrySequence + 1
+			discontinuity = false
+			continue
+		}
+
+		if discontinuity || s.discontinuity {
+			mpegts.MarkDiscontinuity(data)
+		}
+		discontinuity = false
+		s.discontinuity = false
+
+		if _, err := w.Write(data); err != nil {
+			return written, err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		s.nextSequence = entrySequence + 1
+		written++
+
+		if s.adapt(time.Since(start), segmentDuration(entry)) {
+			break
+		}
+	}
+
+	return written, nil
+}
+
+// segment fetches a segment, decrypting it when needed. The returned data
+// can be modified.
+func (s *tsStreamer) segment(ctx context.Context, rawURI string, base *url.URL, key *m3uparser.M3UTag, sequence int64) ([]byte, error) {
+
+	uri, err := url.Parse(rawURI)
+	if err != nil {
+		return nil, err
+	}
+
+	client, proxy := s.stream.route()
+	resp, err := fetchShared(ctx, base.ResolveReference(uri).String(), client, proxy, s.stream.headers, false)
+	if err != nil {
+		return nil, err
+	}
+
+	method := "NONE"
+	if key != nil {
+		method, _ = key.GetAttribute("METHOD")
+	}
+
+	switch method {
+	case "NONE":
+		// The response body is shared with other clients
+		return bytes.Clone(resp.body), nil
+	case "AES-128":
+		return s.decrypt(ctx, resp.body, base, key, sequence)
+	default:
+		return nil, errUnsupportedSegments
+	}
+}
+
+// decrypt deciphers an AES-128 segment, the IV defaults to the media
+// sequence number of the segment.
+func (s *tsStreamer) decrypt(ctx context.Context, data []byte, base *url.URL, key *m3uparser.M3UTag, sequence int64) ([]byte, error) {
+
+	keyURI, _ := key.GetAttribute("URI")
+	uri, err := url.Parse(keyURI)
+	if err != nil {
+		return nil, err
+	}
+	keyURI = base.ResolveReference(uri).String()
+
+	secret, ok := s.keys[keyURI]
+	if !ok {
+		client, proxy := s.stream.route()
+		resp, err := executeRequestContext(ctx, http.MethodGet, keyURI, client, proxy, s.stream.headers)
+		if err != nil {
+			return nil, err
+		}
+		secret, err = io.ReadAll(io.LimitReader(resp.Body, aes.BlockSize+1))
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(secret) != aes.BlockSize {
+			return nil, errors.New("invalid AES-128 key")
+		}
+		s.keys[keyURI] = secret
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if value, ok := key.GetAttribute("IV"); ok {
+		value = strings.TrimPrefix(strings.TrimPrefix(value, "0x"), "0X")
+		decoded, err := hex.DecodeString(value)
+		if err != nil || len(decoded) != aes.BlockSize {
+			return nil, errors.New("invalid AES-128 IV")
+		}
+		iv = decoded
+	} else {
+		binary.BigEndian.PutUint64(iv[8:], uint64(sequence))
+	}
+
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid AES-128 segment size")
+	}
+
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("invalid AES-128 padding")
+	}
+	return plain[:len(plain)-padding], nil
+}
+
+// adapt switches variants, when enabled, following how long the last
+// segment took to download. It reports whether the variant changed.
+func (s *tsStreamer) adapt(elapsed time.Duration, duration time.Duration) bool {
+
+	if !currentConfig().TSStream.Adaptive || len(s.variants) < 2 || duration <= 0 {
+		return false
+	}
+
+	ratio := float64(elapsed) / float64(duration)
+	if ratio > slowRatio {
+		s.slow++
+	} else {
+		s.slow = 0
+	}
+	if ratio < fastRatio {
+		s.fast++
+	} else {
+		s.fast = 0
+	}
+
+	next := s.current
+	switch {
+	case s.slow >= slowSegments && s.current > 0:
+		next = s.current - 1
+	case s.fast >= fastSegments && s.current < s.maxVariant():
+		next = s.current + 1
+	default:
+		return false
+	}
+
+	log.Printf("Transport stream of stream %s switching to variant of %d bps\n", s.stream.id, s.variants[next].bandwidth)
+	s.current = next
+	s.mediaURI = s.variants[next].uri
+	s.discontinuity = true
+	s.slow, s.fast = 0, 0
+	return true
+}
+
+func hasTag(playlist *m3uparser.M3UPlaylist, name string) bool {
+	if playlist.Tags.Exist(name) {
+		return true
+	}
+	for _, entry := range playlist.Entries {
+		if entry.Tags.Exist(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func lastTag(tags m3uparser.M3UTags, name string) *m3uparser.M3UTag {
+	for i := len(tags) - 1; i >= 0; i-- {
+		if tags[i].Tag == name {
+			return &tags[i]
+		}
+	}
+	return nil
+}
+
+// segmentDuration reads the duration of a segment from its EXTINF tag, which
+// may be a decimal number.
+func segmentDuration(entry m3uparser.M3UEntry) time.Duration {
+	value := strings.SplitN(entry.Tags.GetValue("EXTINF"), ",", 2)[0]
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,248 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package streamserver
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/a13labs/m3uproxy/pkg/auth"
+)
+
+const (
+	reloadPlaylist = 1 << iota
+	reloadAuth
+	reloadSecurity
+	reloadServerConfig
+	reloadCache
+	reloadEntitlements
+	reloadProxyPools
+	reloadHDHomeRun
+
+	reloadAll = reloadPlaylist | reloadAuth | reloadSecurity | reloadServerConfig |
+		reloadCache | reloadEntitlements | reloadProxyPools | reloadHDHomeRun
+)
+
+const defaultWatchTime = 5
+
+var reloadMutex sync.Mutex
+
+type fileWatcher struct {
+	mtimes map[string]time.Time
+	stop   chan bool
+}
+
+func newFileWatcher() *fileWatcher {
+	return &fileWatcher{
+		mtimes: make(map[string]time.Time),
+		stop:   make(chan bool),
+	}
+}
+
+// watchedFiles maps each configuration file to the subsystem that must be
+// re-applied when it changes.
+func watchedFiles() map[string]int {
+	files := make(map[string]int)
+	if ConfigPath != "" {
+		files[ConfigPath] |= reloadServerConfig
+	}
+	if playlist := currentConfig().Playlist; playlist != "" {
+		files[playlist] |= reloadPlaylist
+	}
+	if authFile := auth.GetStoragePath(); authFile != "" {
+		files[authFile] |= reloadAuth
+	}
+	return files
+}
+
+// poll checks the modification time of every watched file and returns the
+// subsystems affected by the files that changed since the previous poll.
+func (fw *fileWatcher) poll() int {
+	changes := 0
+	for file, subsystem := range watchedFiles() {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		last, seen := fw.mtimes[file]
+		fw.mtimes[file] = info.ModTime()
+		if seen && !info.ModTime().Equal(last) {
+			log.Printf("Detected change on %s\n", file)
+			changes |= subsystem
+		}
+	}
+	return changes
+}
+
+func (fw *fileWatcher) run() {
+
+	interval := currentConfig().WatchTime
+	if interval < 0 {
+		log.Println("Configuration watcher disabled")
+		return
+	}
+	if interval == 0 {
+		interval = defaultWatchTime
+	}
+
+	fw.poll()
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-fw.stop:
+			return
+		case <-ticker.C:
+			if changes := fw.poll(); changes != 0 {
+				reload(changes)
+			}
+		}
+	}
+}
+
+func (fw *fileWatcher) close() {
+	close(fw.stop)
+}
+
+// Reload re-applies the whole configuration without touching the listener
+// or the streams being served.
+func Reload() {
+	reload(reloadAll)
+}
+
+func reload(subsystems int) {
+
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	if subsystems&reloadServerConfig != 0 {
+		subsystems |= applyServerConfig()
+	}
+
+	if subsystems&reloadAuth != 0 {
+		log.Println("Reloading authentication")
+		if err := auth.InitializeAuth(currentConfig().Auth); err != nil {
+			log.Printf("Failed to initialize authentication: %s\n", err)
+		}
+	}
+
+	if subsystems&reloadSecurity != 0 {
+		log.Println("Reloading security rules")
+		if err := configureSecurity(); err != nil {
+			log.Printf("Failed to configure security: %s\n", err)
+		}
+	}
+
+	if subsystems&reloadCache != 0 {
+		log.Println("Reloading segment cache")
+		configureCache()
+	}
+
+	if subsystems&reloadEntitlements != 0 {
+		log.Println("Reloading channel packages")
+		if err := configureEntitlements(); err != nil {
+			log.Printf("Failed to configure channel packages: %s\n", err)
+		}
+	}
+
+	if subsystems&reloadProxyPools != 0 {
+		log.Println("Reloading proxy pools")
+		if err := configureProxyPools(); err != nil {
+			log.Printf("Failed to configure proxy pools: %s\n", err)
+		}
+	}
+
+	if subsystems&reloadHDHomeRun != 0 {
+		log.Println("Reloading HDHomeRun emulation")
+		if err := configureHDHomeRun(); err != nil {
+			log.Printf("Failed to configure HDHomeRun emulation: %s\n", err)
+		}
+	}
+
+	if subsystems&reloadPlaylist != 0 {
+		log.Println("Reloading playlist")
+		go func() {
+			if err := LoadStreams(); err != nil {
+				log.Printf("Failed to reload playlist: %s\n", err)
+			}
+		}()
+	}
+}
+
+// applyServerConfig re-reads the server configuration and returns the
+// subsystems affected by the differences with the running one.
+func applyServerConfig() int {
+
+	newConfig, err := readServerConfig(ConfigPath)
+	if err != nil {
+		log.Printf("Failed to reload server configuration: %s\n", err)
+		return 0
+	}
+
+	current := currentConfig()
+	changes := 0
+	if newConfig.Playlist != current.Playlist {
+		changes |= reloadPlaylist
+	}
+	if !bytes.Equal(newConfig.Auth, current.Auth) {
+		changes |= reloadAuth
+	}
+	if !reflect.DeepEqual(newConfig.Security, current.Security) {
+		changes |= reloadSecurity
+	}
+	if newConfig.Cache != current.Cache {
+		changes |= reloadCache
+	}
+	if !reflect.DeepEqual(newConfig.Packages, current.Packages) || !reflect.DeepEqual(newConfig.Entitlements, current.Entitlements) {
+		changes |= reloadEntitlements
+	}
+	if !reflect.DeepEqual(newConfig.ProxyPools, current.ProxyPools) {
+		changes |= reloadProxyPools
+	}
+	if !reflect.DeepEqual(newConfig.HDHomeRun, current.HDHomeRun) {
+		changes |= reloadHDHomeRun
+	}
+	remapChanged := newConfig.RemapSecret != current.RemapSecret
+	if newConfig.Port != current.Port {
+		log.Printf("Port change to %d requires a restart, keeping %d\n", newConfig.Port, current.Port)
+		newConfig.Port = current.Port
+	}
+	if newConfig.LogFile != current.LogFile {
+		setupLogging(newConfig.LogFile)
+	}
+
+	setConfig(newConfig)
+
+	if remapChanged {
+		log.Println("Remap secret changed, remapped URIs already issued are no longer valid")
+		if err := configureRemap(); err != nil {
+			log.Printf("Failed to configure remap: %s\n", err)
+		}
+	}
+
+	return changes
+}
@@ -0,0 +1,74 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package xmltv
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// Channel is a <channel> element of an XMLTV document.
+type Channel struct {
+	ID           string   `xml:"id,attr" json:"id"`
+	DisplayNames []string `xml:"display-name" json:"display_names"`
+}
+
+// DecodeChannels reads the channels of an XMLTV document, skipping the
+// programmes so large guides are not loaded in memory.
+func DecodeChannels(reader io.Reader) ([]Channel, error) {
+
+	decoder := xml.NewDecoder(reader)
+	decoder.Strict = false
+
+	channels := make([]Channel, 0)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch start.Name.Local {
+		case "channel":
+			channel := Channel{}
+			if err := decoder.DecodeElement(&channel, &start); err != nil {
+				return nil, err
+			}
+			if channel.ID != "" {
+				channels = append(channels, channel)
+			}
+		case "programme":
+			if err := decoder.Skip(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return channels, nil
+}
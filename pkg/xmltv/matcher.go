@@ -0,0 +1,280 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package xmltv
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	DefaultThreshold = 0.85
+
+	// Candidates scoring within ambiguityMargin of the best one make a
+	// match ambiguous.
+	ambiguityMargin = 0.05
+	maxCandidates   = 3
+)
+
+const (
+	MatchAssigned  = "assigned"
+	MatchAmbiguous = "ambiguous"
+	MatchUnmatched = "unmatched"
+)
+
+// Candidate is an EPG channel scored against a playlist entry title.
+type Candidate struct {
+	ID          string  `json:"id"`
+	DisplayName string  `json:"display_name"`
+	Score       float64 `json:"score"`
+}
+
+// Match is the outcome of matching one playlist entry title.
+type Match struct {
+	Title      string      `json:"title"`
+	CurrentID  string      `json:"current_id,omitempty"`
+	AssignedID string      `json:"assigned_id,omitempty"`
+	Status     string      `json:"status"`
+	Candidates []Candidate `json:"candidates,omitempty"`
+}
+
+type matcherEntry struct {
+	id          string
+	displayName string
+	normalized  string
+	tokens      []string
+}
+
+// Matcher finds the EPG channel that best matches a playlist entry title.
+type Matcher struct {
+	threshold float64
+	entries   []matcherEntry
+	ids       map[string]bool
+}
+
+var qualityTokens = map[string]bool{
+	"hd":    true,
+	"fhd":   true,
+	"uhd":   true,
+	"sd":    true,
+	"4k":    true,
+	"hevc":  true,
+	"h265":  true,
+	"1080p": true,
+	"720p":  true,
+}
+
+var accents = map[rune]rune{
+	'á': 'a', 'à': 'a', 'â': 'a', 'ã': 'a', 'ä': 'a', 'å': 'a',
+	'é': 'e', 'è': 'e', 'ê': 'e', 'ë': 'e',
+	'í': 'i', 'ì': 'i', 'î': 'i', 'ï': 'i',
+	'ó': 'o', 'ò': 'o', 'ô': 'o', 'õ': 'o', 'ö': 'o',
+	'ú': 'u', 'ù': 'u', 'û': 'u', 'ü': 'u',
+	'ç': 'c', 'ñ': 'n',
+}
+
+// Normalize lowercases a channel name, strips accents, punctuation and
+// quality markers such as HD or 4K.
+func Normalize(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if a, ok := accents[r]; ok {
+			r = a
+		}
+		switch {
+		case r == '+':
+			b.WriteString(" plus ")
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		default:
+			b.WriteRune(' ')
+		}
+	}
+
+	tokens := make([]string, 0)
+	for _, token := range strings.Fields(b.String()) {
+		if !qualityTokens[token] {
+			tokens = append(tokens, token)
+		}
+	}
+	return strings.Join(tokens, " ")
+}
+
+func NewMatcher(channels []Channel, threshold float64) *Matcher {
+	if threshold <= 0 || threshold > 1 {
+		threshold = DefaultThreshold
+	}
+
+	m := &Matcher{
+		threshold: threshold,
+		entries:   make([]matcherEntry, 0),
+		ids:       make(map[string]bool),
+	}
+
+	for _, channel := range channels {
+		m.ids[channel.ID] = true
+		for _, displayName := range channel.DisplayNames {
+			normalized := Normalize(displayName)
+			if normalized == "" {
+				continue
+			}
+			m.entries = append(m.entries, matcherEntry{
+				id:          channel.ID,
+				displayName: displayName,
+				normalized:  normalized,
+				tokens:      strings.Fields(normalized),
+			})
+		}
+	}
+	return m
+}
+
+// HasChannel reports whether id is a channel of the EPG.
+func (m *Matcher) HasChannel(id string) bool {
+	return m.ids[id]
+}
+
+// Match scores every EPG channel against title and decides whether the best
+// candidate can be assigned automatically.
+func (m *Matcher) Match(title, currentID string) Match {
+
+	result := Match{
+		Title:     title,
+		CurrentID: currentID,
+		Status:    MatchUnmatched,
+	}
+
+	normalized := Normalize(title)
+	if normalized == "" {
+		return result
+	}
+	tokens := strings.Fields(normalized)
+
+	// Keep the best score of each channel across its display names
+	best := make(map[string]Candidate)
+	for _, entry := range m.entries {
+		score := similarity(normalized, tokens, entry)
+		if c, ok := best[entry.id]; !ok || score > c.Score {
+			best[entry.id] = Candidate{ID: entry.id, DisplayName: entry.displayName, Score: score}
+		}
+	}
+
+	candidates := make([]Candidate, 0, len(best))
+	for _, c := range best {
+		candidates = append(candidates, c)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Score == candidates[j].Score {
+			return candidates[i].ID < candidates[j].ID
+		}
+		return candidates[i].Score > candidates[j].Score
+	})
+	if len(candidates) > maxCandidates {
+		candidates = candidates[:maxCandidates]
+	}
+	result.Candidates = candidates
+
+	if len(candidates) == 0 || candidates[0].Score < m.threshold {
+		return result
+	}
+
+	if len(candidates) > 1 && candidates[1].Score >= m.threshold && candidates[0].Score-candidates[1].Score < ambiguityMargin {
+		result.Status = MatchAmbiguous
+		return result
+	}
+
+	result.Status = MatchAssigned
+	result.AssignedID = candidates[0].ID
+	return result
+}
+
+func similarity(normalized string, tokens []string, entry matcherEntry) float64 {
+	if normalized == entry.normalized {
+		return 1
+	}
+	if strings.ReplaceAll(normalized, " ", "") == strings.ReplaceAll(entry.normalized, " ", "") {
+		return 0.99
+	}
+	// Numbered siblings, like "Eurosport 1" and "Eurosport 2", are
+	// different channels however close their names are
+	if a, b := numbers(normalized), numbers(entry.normalized); a != "" && b != "" && a != b {
+		return 0
+	}
+
+	editScore := 1 - float64(levenshtein(normalized, entry.normalized))/float64(max(utf8.RuneCountInString(normalized), utf8.RuneCountInString(entry.normalized)))
+	tokenScore := jaccard(tokens, entry.tokens)
+
+	if editScore > tokenScore {
+		return editScore
+	}
+	return tokenScore
+}
+
+// numbers returns the runs of digits of a normalized name, space separated.
+func numbers(normalized string) string {
+	return strings.Join(strings.FieldsFunc(normalized, func(r rune) bool {
+		return !unicode.IsDigit(r)
+	}), " ")
+}
+
+func jaccard(a, b []string) float64 {
+	set := make(map[string]int)
+	for _, t := range a {
+		set[t] |= 1
+	}
+	for _, t := range b {
+		set[t] |= 2
+	}
+	intersection := 0
+	for _, v := range set {
+		if v == 3 {
+			intersection++
+		}
+	}
+	if len(set) == 0 {
+		return 0
+	}
+	return float64(intersection) / float64(len(set))
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
@@ -0,0 +1,121 @@
+/*
+Copyright © 2024 Alexandre Pires
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package xmltv
+
+import (
+	"strings"
+	"testing"
+)
+
+const testGuide = `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="RTP1.pt">
+    <display-name>RTP 1</display-name>
+    <display-name>RTP1 HD</display-name>
+  </channel>
+  <channel id="RTP2.pt">
+    <display-name>RTP 2</display-name>
+  </channel>
+  <channel id="SportTV1.pt">
+    <display-name>Sport TV 1</display-name>
+  </channel>
+  <channel id="SportTV2.pt">
+    <display-name>Sport TV 2</display-name>
+  </channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="RTP1.pt">
+    <title>News</title>
+  </programme>
+</tv>`
+
+func TestDecodeChannels(t *testing.T) {
+	channels, err := DecodeChannels(strings.NewReader(testGuide))
+	if err != nil {
+		t.Fatalf("Failed to decode channels: %v", err)
+	}
+
+	if len(channels) != 4 {
+		t.Fatalf("Unexpected number of channels. Expected: 4, Got: %d", len(channels))
+	}
+
+	if channels[0].ID != "RTP1.pt" || len(channels[0].DisplayNames) != 2 {
+		t.Errorf("Unexpected channel: %+v", channels[0])
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := map[string]string{
+		"RTP 1 HD":         "rtp 1",
+		"SIC Notícias FHD": "sic noticias",
+		"Canal+ 4K":        "canal plus",
+		"  TVI-Reality ":   "tvi reality",
+	}
+	for input, expected := range tests {
+		if got := Normalize(input); got != expected {
+			t.Errorf("Unexpected normalization of '%s'. Expected: '%s', Got: '%s'", input, expected, got)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	channels, _ := DecodeChannels(strings.NewReader(testGuide))
+	matcher := NewMatcher(channels, 0.8)
+
+	match := matcher.Match("RTP1 FHD", "")
+	if match.Status != MatchAssigned || match.AssignedID != "RTP1.pt" {
+		t.Errorf("Unexpected match: %+v", match)
+	}
+
+	match = matcher.Match("Sport TV", "")
+	if match.Status != MatchAmbiguous || match.AssignedID != "" {
+		t.Errorf("Expected ambiguous match, got: %+v", match)
+	}
+
+	match = matcher.Match("Discovery Channel", "")
+	if match.Status != MatchUnmatched {
+		t.Errorf("Expected no match, got: %+v", match)
+	}
+
+	if !matcher.HasChannel("RTP2.pt") || matcher.HasChannel("RTP3.pt") {
+		t.Error("Unexpected result for HasChannel")
+	}
+}
+
+func TestMatchNumberedSiblings(t *testing.T) {
+	matcher := NewMatcher([]Channel{{ID: "Eurosport1.fr", DisplayNames: []string{"Eurosport 1"}}}, DefaultThreshold)
+
+	tests := []struct {
+		title  string
+		status string
+	}{
+		{"Eurosport 1 HD", MatchAssigned},
+		{"Eurosport1", MatchAssigned},
+		{"Eurosport 2", MatchUnmatched},
+		{"Eurosport 12", MatchUnmatched},
+	}
+
+	for _, test := range tests {
+		if match := matcher.Match(test.title, ""); match.Status != test.status {
+			t.Errorf("Unexpected status for '%s'. Expected: %s, Got: %+v", test.title, test.status, match)
+		}
+	}
+}